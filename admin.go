@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// volumeChain shows how a volume is attached on this host,
+// from the vdi down to the mountpoint
+type volumeChain struct {
+	Name       string
+	Vdi        string
+	Lun        string `json:",omitempty"`
+	Device     string `json:",omitempty"`
+	Mountpoint string
+	Mounted    bool
+	MountCount int
+	Holders    []string `json:",omitempty"`
+}
+
+// targetLayout is the tgt target of this host and its LUNs
+type targetLayout struct {
+	TargetID  string
+	TargetIqn string
+	Portal    string
+	Luns      []tgtLun
+}
+
+// volumeChain returns the chain of the volume name from volumes,
+// a snapshot of the driver state
+func (d SheepdogDriver) volumeChain(name string, mounts map[string]string, volumes map[string]volumeState) volumeChain {
+	c := volumeChain{
+		Name:       name,
+		Vdi:        d.vdiName(name),
+		Mountpoint: filepath.Join(d.Conf.MountPoint, name),
+	}
+	_, c.Mounted = mounts[c.Mountpoint]
+	if vs, ok := volumes[name]; ok {
+		c.Lun = vs.Lun
+		c.Device = vs.Device
+		c.MountCount = len(vs.IDs)
+		for id := range vs.IDs {
+			c.Holders = append(c.Holders, id)
+		}
+		sort.Strings(c.Holders)
+	}
+	return c
+}
+
+// volumeChains returns the chain of every volume known to the plugin,
+// the volumes of its namespace in the cluster and the ones in its state.
+// It works on a snapshot of the state, the driver mutex is not needed.
+func (d SheepdogDriver) volumeChains() []volumeChain {
+	mounts, err := readMountInfo()
+	if err != nil {
+		log.Warning("Failed to read mountinfo: ", err)
+	}
+
+	volumes := d.State.snapshot()
+	known := make(map[string]bool)
+	for name := range volumes {
+		known[name] = true
+	}
+	vdis, _ := d.ownVdis()
+	for _, o := range vdis {
+		if o.Snapshot == false && d.checkNamespace(o.Options, o.OptionsErr) == nil {
+			known[o.Volume] = true
+		}
+	}
+	var names []string
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	chains := []volumeChain{}
+	for _, name := range names {
+		chains = append(chains, d.volumeChain(name, mounts, volumes))
+	}
+	return chains
+}
+
+// targetLayout returns the tgt target the plugin exports its LUNs on
+func (d SheepdogDriver) targetLayout() targetLayout {
+	return targetLayout{
+		TargetID:  d.Conf.TargetID,
+		TargetIqn: d.Conf.TargetIqn,
+		Portal:    d.Conf.TargetBindIP + ":" + d.Conf.TargetBindPort,
+		Luns:      tgtLunList(d.Runner, d.Conf.TargetID),
+	}
+}
+
+// writeJSON sends v as the response of an admin request
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		v = map[string]string{"Err": err.Error()}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(v); err != nil {
+		log.Debug("Failed to write admin response: ", err)
+	}
+}
+
+// serveAdmin serves the admin API on the unix socket AdminSocket:
+//
+//	GET /volumes   every known volume, vdi, LUN, device, mountpoint and holders
+//	GET /target    the tgt target and its LUNs
+//	GET /sessions  the iSCSI sessions of this host
+//	POST /resize   grow volume to size, the form of the resize command
+func (d SheepdogDriver) serveAdmin() {
+	mux := http.NewServeMux()
+	// /volumes and /target run their commands without the driver mutex,
+	// on the state as last saved
+	mux.HandleFunc("/volumes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.volumeChains(), nil)
+	})
+	mux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.targetLayout(), nil)
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions, err := iscsiSessionList(d.Runner)
+		if sessions == nil {
+			sessions = []iscsiSession{}
+		}
+		writeJSON(w, sessions, err)
+	})
+	mux.HandleFunc("/resize", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		d.lockChanges()
+		err := d.resizeVolume(r.FormValue("volume"), r.FormValue("size"))
+		d.Mutex.Unlock()
+		if err != nil {
+			log.Error(err)
+		}
+		writeJSON(w, map[string]string{}, err)
+	})
+
+	path := d.Conf.AdminSocket
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Error("Failed to create admin socket directory: ", err)
+		return
+	}
+	// a socket left over by a previous run
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		log.Error("Failed to listen on admin socket: ", err)
+		return
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		log.Error("Failed to restrict admin socket: ", err)
+		l.Close()
+		return
+	}
+	log.Infof("Serving admin API on %s", path)
+	if err := http.Serve(l, mux); err != nil {
+		log.Error("Failed to serve admin API: ", err)
+	}
+}
+
+// adminPost sends a request to the admin API of the running plugin
+// and returns the error it answered with
+func adminPost(socket, path string, form url.Values) error {
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	resp, err := client.PostForm("http://admin"+path, form)
+	if err != nil {
+		return errors.New("Failed to reach the plugin on " + socket + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var answer struct{ Err string }
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil || answer.Err == "" {
+		return errors.New("Admin request failed: " + resp.Status)
+	}
+	return errors.New(answer.Err)
+}
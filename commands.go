@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// usage prints the options and the subcommands of the plugin binary
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without a command the plugin server is started.\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  resize <volume> <size>\tgrow a volume and its filesystem\n")
+	fmt.Fprintf(os.Stderr, "  break-lock <volume>\tforget the host a volume is attached on\n")
+	fmt.Fprintf(os.Stderr, "  status\t\tshow the cluster, the target and the volumes of this host\n")
+	fmt.Fprintf(os.Stderr, "  inspect <volume>\tshow a volume from its vdi down to its mountpoint\n")
+	fmt.Fprintf(os.Stderr, "  doctor\t\tcheck that this host can run the plugin\n\n")
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a subcommand instead of the plugin server
+// and returns the exit status
+func runCommand(args []string) int {
+	if *debug == false {
+		log.SetLevel(log.WarnLevel)
+	}
+
+	switch args[0] {
+	case "resize":
+		return cmdResize(args[1:])
+	case "break-lock":
+		return cmdBreakLock(args[1:])
+	case "status":
+		return cmdStatus(args[1:])
+	case "inspect":
+		return cmdInspect(args[1:])
+	case "doctor":
+		return cmdDoctor(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+	usage()
+	return 2
+}
+
+// resize <volume> <size>
+func cmdResize(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: resize <volume> <size>")
+		return 2
+	}
+
+	d := loadSheepdogDriver(*cfgFile, &execRunner{})
+	var err error
+	if d.Conf.AdminSocket != "" {
+		// the plugin resizes the volume between the Docker requests
+		err = adminPost(d.Conf.AdminSocket, "/resize", url.Values{"volume": {args[0]}, "size": {args[1]}})
+	} else if lock, ok, lockErr := d.readLock(d.vdiName(args[0])); lockErr != nil {
+		err = lockErr
+	} else if ok {
+		err = errors.New("Volume is attached on host " + lock.Host + ", set AdminSocket to resize volumes in use")
+	} else {
+		err = d.resizeVolume(args[0], args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Resized %s to %s\n", args[0], args[1])
+	return 0
+}
+
+// break-lock <volume>
+func cmdBreakLock(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: break-lock <volume>")
+		return 2
+	}
+
+	d := loadSheepdogDriver(*cfgFile, &execRunner{})
+	held, err := d.breakLock(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Broke the lock of %s held by %s since %s\n", args[0], held.Host, held.Time.Format(time.RFC3339))
+	return 0
+}
+
+// status
+func cmdStatus(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: status")
+		return 2
+	}
+
+	d := loadSheepdogDriver(*cfgFile, &execRunner{})
+	rc := 0
+	cluster, err := dogClusterInfo(d.Runner, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err != nil {
+		cluster = "unreachable: " + err.Error()
+		rc = 1
+	}
+	fmt.Printf("Cluster:  %s\n", cluster)
+
+	target := d.targetLayout()
+	fmt.Printf("Target:   %s %s on %s, %d LUN(s)\n", target.TargetID, target.TargetIqn, target.Portal, len(target.Luns))
+	sessions, err := iscsiSessionList(d.Runner)
+	if err != nil {
+		fmt.Printf("Sessions: unknown: %v\n", err)
+		rc = 1
+	} else {
+		fmt.Printf("Sessions: %d\n", len(sessions))
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tVDI\tLUN\tDEVICE\tMOUNTPOINT\tMOUNTED\tCOUNT")
+	for _, c := range d.volumeChains() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%d\n", c.Name, c.Vdi, orDash(c.Lun), orDash(c.Device), c.Mountpoint, c.Mounted, c.MountCount)
+	}
+	w.Flush()
+	return rc
+}
+
+// inspect <volume>
+func cmdInspect(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: inspect <volume>")
+		return 2
+	}
+
+	d := loadSheepdogDriver(*cfgFile, &execRunner{})
+	name := args[0]
+	mounts, err := readMountInfo()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read mountinfo:", err)
+	}
+	c := d.volumeChain(name, mounts, d.State.snapshot())
+	exist := d.vdiExist(c.Vdi)
+	if exist == false && c.MountCount == 0 {
+		fmt.Fprintln(os.Stderr, "Volume Not Found:", name)
+		return 1
+	}
+
+	// what is actually set up on the host, which may differ from the state
+	var lun, device string
+	for _, l := range tgtLunList(d.Runner, d.Conf.TargetID) {
+		if strings.HasSuffix(l.BackingStore, ":"+c.Vdi) {
+			lun = l.Lun + " (" + l.BackingStore + ")"
+			device, _ = filepath.EvalSymlinks(iscsiByPath(d.Conf.TargetBindIP, d.Conf.TargetBindPort, d.Conf.TargetIqn, l.Lun))
+		}
+	}
+	mounted := "not mounted"
+	if source, ok := mounts[c.Mountpoint]; ok {
+		mounted = "mounted from " + source
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Volume:\t%s\n", c.Name)
+	fmt.Fprintf(w, "Vdi:\t%s (exists: %t)\n", c.Vdi, exist)
+	fmt.Fprintf(w, "LUN:\t%s\t(state: %s)\n", orDash(lun), orDash(c.Lun))
+	fmt.Fprintf(w, "Device:\t%s\t(state: %s)\n", orDash(device), orDash(c.Device))
+	fmt.Fprintf(w, "Mountpoint:\t%s\t(%s)\n", c.Mountpoint, mounted)
+	fmt.Fprintf(w, "Holders:\t%s\n", orDash(strings.Join(c.Holders, ", ")))
+	w.Flush()
+
+	if exist == true {
+		status, err := json.MarshalIndent(d.volumeStatus(name, c.Vdi), "", "    ")
+		if err == nil {
+			fmt.Printf("Status: %s\n", status)
+		}
+	}
+	return 0
+}
+
+// doctor
+func cmdDoctor(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: doctor")
+		return 2
+	}
+
+	d := loadSheepdogDriver(*cfgFile, &execRunner{})
+	if printDoctor(d.doctor()) == false {
+		return 1
+	}
+	return 0
+}
+
+// orDash prints empty values as -
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
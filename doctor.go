@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fsTools are the commands needed to format and grow each filesystem
+var fsTools = map[string][]string{
+	"xfs":   {"mkfs.xfs", "xfs_growfs"},
+	"ext4":  {"mkfs.ext4", "resize2fs"},
+	"btrfs": {"mkfs.btrfs", "btrfs"},
+}
+
+// hostTools are the commands the driver runs through sudo besides the filesystem tools
+var hostTools = []string{"dog", "tgtadm", "iscsiadm", "lsblk", "blkid", "mount", "umount"}
+
+// checkResult is the outcome of one doctor check.
+// Fix tells the operator how to repair a failed check.
+type checkResult struct {
+	Name string
+	Err  error
+	Fix  string
+	// a failed optional check is only a warning
+	Optional bool
+	// the check is about the running host (daemons, cluster, directories)
+	// rather than its setup, it may pass later without changing anything
+	Runtime bool
+}
+
+// lookCommand finds a command in PATH or in the sbin directories,
+// which are not always in the PATH of the plugin
+func lookCommand(name string) error {
+	if _, err := exec.LookPath(name); err == nil {
+		return nil
+	}
+	for _, dir := range []string{"/usr/local/sbin", "/usr/sbin", "/sbin"} {
+		if fi, err := os.Stat(dir + "/" + name); err == nil && fi.Mode()&0111 != 0 {
+			return nil
+		}
+	}
+	return errors.New(name + " not found")
+}
+
+// accessWrite is W_OK of access(2), which syscall does not define
+const accessWrite = 0x2
+
+// checkWritable checks that files can be created in dir without
+// changing anything. A missing dir is a failure, telling whether it
+// can be created in its nearest existing parent.
+func checkWritable(dir string) error {
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if fi.IsDir() == false {
+			return errors.New(dir + " is not a directory")
+		}
+		if err := syscall.Access(dir, accessWrite); err != nil {
+			return errors.New(dir + " is not writable: " + err.Error())
+		}
+		return nil
+	}
+	if os.IsNotExist(err) == false {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	for {
+		fi, err := os.Stat(parent)
+		if err == nil {
+			if fi.IsDir() == false {
+				return errors.New(dir + " does not exist and " + parent + " is not a directory")
+			}
+			if err := syscall.Access(parent, accessWrite); err != nil {
+				return errors.New(dir + " does not exist and " + parent + " is not writable")
+			}
+			return errors.New(dir + " does not exist, the plugin creates it in " + parent)
+		}
+		if os.IsNotExist(err) == false || parent == filepath.Dir(parent) {
+			return err
+		}
+		parent = filepath.Dir(parent)
+	}
+}
+
+// doctor checks that this host can run the plugin
+func (d SheepdogDriver) doctor() []checkResult {
+	var results []checkResult
+	add := func(name string, err error, fix string, optional bool) {
+		results = append(results, checkResult{Name: name, Err: err, Fix: fix, Optional: optional})
+	}
+	runtime := func(name string, err error, fix string) {
+		results = append(results, checkResult{Name: name, Err: err, Fix: fix, Runtime: true})
+	}
+
+	// commands
+	add("sudo is installed", lookCommand("sudo"), "install sudo", false)
+	packages := map[string]string{
+		"dog":      "sheepdog",
+		"tgtadm":   "scsi-target-utils (tgt on Ubuntu)",
+		"iscsiadm": "iscsi-initiator-utils (open-iscsi on Ubuntu)",
+		"lsblk":    "util-linux",
+		"blkid":    "util-linux",
+		"mount":    "util-linux",
+		"umount":   "util-linux",
+	}
+	for _, cmd := range hostTools {
+		add(cmd+" is installed", lookCommand(cmd), "install "+packages[cmd], false)
+	}
+	fsPackages := map[string]string{"xfs": "xfsprogs", "ext4": "e2fsprogs", "btrfs": "btrfs-progs"}
+	for _, fs := range []string{"xfs", "ext4", "btrfs"} {
+		optional := fs != d.Conf.DefaultFsType
+		for _, cmd := range fsTools[fs] {
+			add(cmd+" is installed", lookCommand(cmd), "install "+fsPackages[fs]+" to use "+fs+" volumes", optional)
+		}
+	}
+
+	// sudo without a password for every command the driver runs
+	needed := append([]string{}, hostTools...)
+	needed = append(needed, fsTools[d.Conf.DefaultFsType]...)
+	var denied []string
+	for _, cmd := range needed {
+		if _, err := d.Runner.Run("sudo", "-n", "-l", cmd); err != nil {
+			denied = append(denied, cmd)
+		}
+	}
+	var err error
+	if len(denied) > 0 {
+		err = errors.New("sudo asks a password or refuses: " + strings.Join(denied, ", "))
+	}
+	add("sudo runs the commands without password", err,
+		"allow them with NOPASSWD in /etc/sudoers.d for the user running the plugin", false)
+
+	// daemons
+	_, err = d.Runner.Run("sudo", "-n", "tgtadm", "--lld", "iscsi", "--mode", "system", "--op", "show")
+	runtime("tgtd is running", err, "start it with: systemctl enable --now tgtd")
+	_, err = d.Runner.Run("pidof", "iscsid")
+	if err != nil {
+		err = errors.New("iscsid process not found")
+	}
+	runtime("iscsid is running", err, "start it with: systemctl enable --now iscsid")
+
+	// sheepdog
+	conn, err := net.DialTimeout(d.Sheep.Network, d.Sheep.Address, sheepDialTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	fix := "start sheep on this host or set LocalSheepSocket to its socket"
+	if d.Conf.RemoteSheep == true {
+		fix = "check that sheep listens on RemoteSheepIP:RemoteSheepPort and the firewall lets it through"
+	}
+	runtime("sheep answers on "+d.Sheep.Network+" "+d.Sheep.Address, err, fix)
+
+	status, err := dogClusterInfo(d.Runner, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err == nil && strings.Contains(status, "running") == false {
+		err = errors.New(status)
+	}
+	runtime("sheepdog cluster is running", err,
+		"check dog cluster info and dog node list, format the cluster with dog cluster format if it is new")
+
+	// directories
+	runtime("MountPoint "+d.Conf.MountPoint+" is writable", checkWritable(d.Conf.MountPoint),
+		"create it and make it writable by the plugin, or change MountPoint")
+	runtime("StateDir "+d.Conf.StateDir+" is writable", checkWritable(d.Conf.StateDir),
+		"create it and make it writable by the plugin, or change StateDir")
+
+	return results
+}
+
+// preflight runs the doctor checks at startup and logs the failures.
+// It returns false when the plugin can not work on this host, that is
+// when tools or sudo are missing. The daemons and the cluster may come
+// up after the plugin, their failures are only warnings here and the
+// requests fail until they do; doctor reports them as failures.
+func (d SheepdogDriver) preflight() bool {
+	ok := true
+	for _, r := range d.doctor() {
+		if r.Err == nil {
+			log.Debugf("Preflight: %s", r.Name)
+			continue
+		}
+		if r.Optional == true || r.Runtime == true {
+			log.Warningf("Preflight: %s: %v (%s)", r.Name, r.Err, r.Fix)
+			continue
+		}
+		log.Errorf("Preflight: %s: %v (%s)", r.Name, r.Err, r.Fix)
+		ok = false
+	}
+	return ok
+}
+
+// printDoctor prints the results of the doctor command
+// and returns false when a required check failed
+func printDoctor(results []checkResult) bool {
+	ok := true
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			fmt.Printf("[ OK ] %s\n", r.Name)
+		case r.Optional == true:
+			fmt.Printf("[WARN] %s: %v\n       fix: %s\n", r.Name, r.Err, r.Fix)
+		default:
+			fmt.Printf("[FAIL] %s: %v\n       fix: %s\n", r.Name, r.Err, r.Fix)
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := checkWritable(dir); err != nil {
+		t.Error(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable(file); err == nil {
+		t.Error("a file is a writable directory")
+	}
+	// a missing directory is reported and not created
+	missing := filepath.Join(dir, "a", "b")
+	if err := checkWritable(missing); err == nil || strings.Contains(err.Error(), "creates it in "+dir) == false {
+		t.Errorf("missing directory: %v", err)
+	}
+	if err := checkWritable(filepath.Join(file, "a")); err == nil || strings.Contains(err.Error(), "not a directory") == false {
+		t.Errorf("missing directory under a file: %v", err)
+	}
+	// nothing is left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("files left: %v", files)
+	}
+}
+
+func TestLookCommand(t *testing.T) {
+	if err := lookCommand("sh"); err != nil {
+		t.Error(err)
+	}
+	if err := lookCommand("dvp-no-such-command"); err == nil {
+		t.Error("found a missing command")
+	}
+}
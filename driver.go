@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
@@ -16,23 +17,57 @@ import (
 // Config model
 type Config struct {
 	DefaultVolSz     string
+	DefaultFsType    string
+	AllowedMountOpts []string
 	MountPoint       string
 	TargetID         string
 	TargetIqn        string
 	TargetBindIP     string
 	TargetBindPort   string
 	VdiSuffix        string
+	VdiNameTemplate  string
+	Namespace        string
 	LocalSheepSocket string
 	RemoteSheep      bool
 	RemoteSheepIP    string
 	RemoteSheepPort  string
-	mountCount       map[string]int
+	NativeClient     bool
+	StateDir         string
+	Hostname         string
+	LockTimeout      string
+
+	// timeouts of the external commands by command, e.g. "mkfs.xfs": "30m"
+	CommandTimeouts map[string]string
+	// retries of the operations failing while sheep or tgtd restart, by operation
+	Retries map[string]RetryPolicy
+
+	// Quotas, unlimited when not set
+	MaxVolumeSize      string
+	MaxProvisionedSize string
+	MaxVolumes         int
+
+	// Prometheus metrics listener, disabled when empty
+	MetricsAddr string
+	// unix socket of the admin API, disabled when empty
+	AdminSocket string
 }
 
 // SheepdogDriver model
 type SheepdogDriver struct {
-	Mutex *sync.Mutex
-	Conf  *Config
+	Mutex  *sync.Mutex
+	Conf   *Config
+	Runner Runner
+	Sheep  *SheepClient
+	State  *driverState
+	Namer  *vdiNamer
+	// options of the listed vdis
+	OptionsCache *optionsCache
+	// attach locks held by this host
+	Locks *lockTable
+	// requests waiting for a retry, on Mutex
+	Gate *retryGate
+	// retry policies by operation
+	Retries map[string]retryPolicy
 }
 
 func processConfig(cfg string) (Config, error) {
@@ -53,6 +88,18 @@ func processConfig(cfg string) (Config, error) {
 	if conf.DefaultVolSz == "" {
 		conf.DefaultVolSz = "10G"
 	}
+	if _, err := parseSize(conf.DefaultVolSz); err != nil {
+		log.Fatal("Error DefaultVolSz is not a valid size: ", conf.DefaultVolSz)
+	}
+	if conf.DefaultFsType == "" {
+		conf.DefaultFsType = "xfs"
+	}
+	if supportedFsTypes[conf.DefaultFsType] == false {
+		log.Fatal("Error DefaultFsType is not supported: ", conf.DefaultFsType)
+	}
+	if conf.AllowedMountOpts == nil {
+		conf.AllowedMountOpts = defaultAllowedMountOpts
+	}
 
 	// Target
 	if conf.TargetID == "" {
@@ -73,6 +120,27 @@ func processConfig(cfg string) (Config, error) {
 		conf.VdiSuffix = "dvp"
 	}
 
+	// '-' separates the namespace from the volume name in the vdi name
+	if conf.Namespace != "" && (volumeNameRe.MatchString(conf.Namespace) == false || strings.Contains(conf.Namespace, "-")) {
+		log.Fatal("Error Namespace is not valid, letters, digits, '_' and '.' only: ", conf.Namespace)
+	}
+	if conf.VdiNameTemplate == "" {
+		conf.VdiNameTemplate = defaultVdiNameTemplate
+		if conf.Namespace != "" {
+			conf.VdiNameTemplate = namespacedVdiNameTemplate
+		}
+	}
+
+	// Quotas
+	for _, size := range []string{conf.MaxVolumeSize, conf.MaxProvisionedSize} {
+		if _, err := parseSize(size); size != "" && err != nil {
+			log.Fatal("Error quota is not a valid size: ", size)
+		}
+	}
+	if conf.MaxVolumes < 0 {
+		log.Fatal("Error MaxVolumes can not be negative: ", conf.MaxVolumes)
+	}
+
 	// Local Sheep
 	if conf.LocalSheepSocket == "" {
 		conf.LocalSheepSocket = "/var/lib/sheepdog/sock"
@@ -90,12 +158,46 @@ func processConfig(cfg string) (Config, error) {
 		conf.RemoteSheep = false
 	}
 
-	// Max 128 Lun, include lun 0 ?
-	conf.mountCount = make(map[string]int, 127)
+	// Driver State
+	if conf.StateDir == "" {
+		conf.StateDir = defaultDir
+	}
+
+	// Attach Lock
+	if conf.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal("Error getting hostname: ", err)
+		}
+		conf.Hostname = hostname
+	}
+	if conf.LockTimeout == "" {
+		conf.LockTimeout = defaultLockTimeout.String()
+	}
+	if timeout, err := time.ParseDuration(conf.LockTimeout); err != nil || timeout <= 0 {
+		log.Fatal("Error LockTimeout is not a valid duration: ", conf.LockTimeout)
+	}
+
+	// Command Timeouts
+	for command, value := range conf.CommandTimeouts {
+		if _, ok := defaultCommandTimeouts[command]; ok == false {
+			log.Fatal("Error CommandTimeouts has an unknown command: ", command)
+		}
+		if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+			log.Fatalf("Error CommandTimeouts of %s is not a valid duration: %s", command, value)
+		}
+	}
+
+	// Retries
+	if _, err := retryPolicies(&conf); err != nil {
+		log.Fatal("Error Retries is not valid: ", err)
+	}
 
 	log.Infof("Using config file: %s", cfg)
 	log.Infof("Set MountPoint to: %s", conf.MountPoint)
 	log.Infof("Set DefaultVolSz to: %s", conf.DefaultVolSz)
+	log.Infof("Set DefaultFsType to: %s", conf.DefaultFsType)
+	log.Infof("Set AllowedMountOpts to: %v", conf.AllowedMountOpts)
 
 	log.Infof("Set TargetID to: %s", conf.TargetID)
 	log.Infof("Set TargetIqn to: %s", conf.TargetIqn)
@@ -103,6 +205,8 @@ func processConfig(cfg string) (Config, error) {
 	log.Infof("Set TargetBindPort to: %s", conf.TargetBindPort)
 
 	log.Infof("Set VdiSuffix to: %s", conf.VdiSuffix)
+	log.Infof("Set VdiNameTemplate to: %s", conf.VdiNameTemplate)
+	log.Infof("Set Namespace to: %s", conf.Namespace)
 
 	log.Infof("Set LocalSheepSocket to: %s", conf.LocalSheepSocket)
 	log.Infof("Set RemoteSheep to: %s", conf.RemoteSheep)
@@ -110,32 +214,43 @@ func processConfig(cfg string) (Config, error) {
 		log.Infof("Set RemoteSheepIP to: %s", conf.RemoteSheepIP)
 		log.Infof("Set RemoteSheepPort to: %s", conf.RemoteSheepPort)
 	}
+	log.Infof("Set NativeClient to: %t", conf.NativeClient)
+	log.Infof("Set MaxVolumeSize to: %s", conf.MaxVolumeSize)
+	log.Infof("Set MaxProvisionedSize to: %s", conf.MaxProvisionedSize)
+	log.Infof("Set MaxVolumes to: %d", conf.MaxVolumes)
+	log.Infof("Set MetricsAddr to: %s", conf.MetricsAddr)
+	log.Infof("Set AdminSocket to: %s", conf.AdminSocket)
+	log.Infof("Set StateDir to: %s", conf.StateDir)
+	log.Infof("Set Hostname to: %s", conf.Hostname)
+	log.Infof("Set LockTimeout to: %s", conf.LockTimeout)
+	log.Infof("Set CommandTimeouts to: %v", conf.CommandTimeouts)
+	log.Infof("Set Retries to: %v", conf.Retries)
 
 	return conf, nil
 }
 
-func prepareTarget(tid string, tiqn string, tip string, tport string) bool {
+func prepareTarget(runner Runner, tid string, tiqn string, tip string, tport string) bool {
 	log.Info("Start tgtTargetNew")
-	err := tgtTargetNew(tid, tiqn)
+	err := tgtTargetNew(runner, tid, tiqn)
 	if err != nil {
 		log.Debug("Error unit.tgtTargetNew: ", err)
 	}
 
 	log.Info("Start tgtTargetBind")
-	err = tgtTargetBind(tid, tip)
+	err = tgtTargetBind(runner, tid, tip)
 	if err != nil {
 		log.Debug("Error unit.tgtTargetBind: ", err)
 	}
 
 	log.Info("Start iscsiDiscovery")
-	targets, err := iscsiDiscovery(string(tip + ":" + tport))
+	targets, err := iscsiDiscovery(runner, string(tip+":"+tport))
 	if err != nil {
 		log.Debug("Error unit.iscsiDiscovery: ", err)
 	}
 	log.Debug("Discovery target: %w", targets)
 
 	log.Info("Start iscsiLogin")
-	err = iscsiLogin(tiqn, string(tip+":"+tport))
+	err = iscsiLogin(runner, tiqn, string(tip+":"+tport))
 	if err != nil {
 		log.Debug("Error unit.iscsiLogin: ", err)
 	}
@@ -143,17 +258,25 @@ func prepareTarget(tid string, tiqn string, tip string, tport string) bool {
 	return true
 }
 
-func newSheepdogDriver(cfgFile string) SheepdogDriver {
-	conf, err := processConfig(cfgFile)
+func newSheepdogDriver(cfgFile string, runner Runner) SheepdogDriver {
+	d := loadSheepdogDriver(cfgFile, runner)
+	conf := d.Conf
+
+	state, err := loadState(d.State.path)
 	if err != nil {
-		log.Fatal("Error processing sheepdog driver config file: ", err)
+		log.Fatal("Error loading driver state: ", err)
+	}
+	d.State = state
+
+	if d.preflight() == false {
+		log.Fatal("Preflight checks failed, run the doctor command for details")
 	}
 
 	targetid := conf.TargetID
 	targetiqn := conf.TargetIqn
 	targetbindip := conf.TargetBindIP
 	targetbindport := conf.TargetBindPort
-	prepareTarget(targetid, targetiqn, targetbindip, targetbindport)
+	prepareTarget(runner, targetid, targetiqn, targetbindip, targetbindport)
 
 	_, err = os.Lstat(conf.MountPoint)
 	if os.IsNotExist(err) {
@@ -162,21 +285,146 @@ func newSheepdogDriver(cfgFile string) SheepdogDriver {
 		}
 	}
 
+	d.reconcile()
+	d.startHeartbeat()
+
+	return d
+}
+
+// loadSheepdogDriver reads the config and returns a driver without
+// touching the iSCSI target, for the plugin subcommands
+func loadSheepdogDriver(cfgFile string, runner Runner) SheepdogDriver {
+	conf, err := processConfig(cfgFile)
+	if err != nil {
+		log.Fatal("Error processing sheepdog driver config file: ", err)
+	}
+
+	namer, err := newVdiNamer(conf.VdiNameTemplate, conf.VdiSuffix, conf.Hostname, conf.Namespace)
+	if err != nil {
+		log.Fatal("Error VdiNameTemplate is not valid: ", err)
+	}
+
+	// the subcommands only report a corrupt state, the plugin moves it aside
+	state, err := readState(filepath.Join(conf.StateDir, "state.json"))
+	if _, ok := err.(*stateCorruptError); ok {
+		log.Error(err)
+	} else if err != nil {
+		log.Fatal("Error loading driver state: ", err)
+	}
+
+	retries, _ := retryPolicies(&conf)
+
+	if r, ok := runner.(timeoutRunner); ok {
+		r.SetTimeouts(commandTimeouts(&conf))
+	}
+
 	d := SheepdogDriver{
-		Conf:  &conf,
-		Mutex: &sync.Mutex{},
+		Conf:    &conf,
+		Mutex:   &sync.Mutex{},
+		Runner:  runner,
+		Sheep:   newSheepClient(&conf),
+		State:   state,
+		Namer:   namer,
+		Retries: retries,
+
+		OptionsCache: newOptionsCache(),
+		Locks:        newLockTable(),
 	}
+	d.Gate = newRetryGate(d.Mutex)
 
 	return d
 }
 
+// vdiCreate creates a vdi with the native client or dog.
+// prealloc has to write every object from the client side,
+// so it is always left to dog.
+func (d SheepdogDriver) vdiCreate(vdiname, size string, opts map[string]string) error {
+	return d.retry("vdi create", func() error {
+		if d.Conf.NativeClient == true && opts["prealloc"] != "true" {
+			_, err := d.Sheep.Create(vdiname, size, opts)
+			return err
+		}
+		return dogVdiCreate(d.Runner, vdiname, size, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort, opts)
+	})
+}
+
+// vdiDelete deletes a vdi with the native client or dog
+func (d SheepdogDriver) vdiDelete(vdiname string) error {
+	return d.retry("vdi delete", func() error {
+		if d.Conf.NativeClient == true {
+			return d.Sheep.Delete(vdiname)
+		}
+		return dogVdiDelete(d.Runner, vdiname, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	})
+}
+
+// vdiExist checks the vdi with the native client or dog
+func (d SheepdogDriver) vdiExist(vdiname string) bool {
+	if d.Conf.NativeClient == true {
+		exist, err := d.Sheep.Exist(vdiname)
+		if err != nil {
+			log.Error("Failed to lookup vdi: ", err)
+			return false
+		}
+		return exist
+	}
+
+	infos, err := d.vdiInfos(vdiname)
+	if err != nil {
+		log.Error("Failed to list vdi: ", err)
+		return false
+	}
+	for _, info := range infos {
+		if info.Snapshot == false && info.Name == vdiname {
+			return true
+		}
+	}
+	return false
+}
+
 // Create API
 func (d SheepdogDriver) Create(r volume.Request) volume.Response {
 	log.Infof("Create: %s, %v", r.Name, r.Options)
 	var volumeSize string
-	d.Mutex.Lock()
+	d.lockChanges()
 	defer d.Mutex.Unlock()
 
+	if err := d.validateVolumeName(r.Name); err != nil {
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	if err := d.validateCreateOptions(r.Options); err != nil {
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	// namespace: only the namespace of this plugin can be used
+	if ns, ok := r.Options["namespace"]; ok && ns != d.Conf.Namespace {
+		err := errors.New("Namespace " + ns + " is not served by this plugin")
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	if _, ok, _ := d.findSnapshot(r.Name); ok {
+		err := errors.New("Volume already exists: " + r.Name)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	// snapshot-of: take a snapshot of an existing volume instead of
+	// creating a new vdi. The volume name is used as the snapshot tag.
+	if optsSnap, ok := r.Options["snapshot-of"]; ok {
+		return d.createSnapshot(r.Name, optsSnap)
+	}
+
+	// size on an existing volume: Create never changes a volume,
+	// it is grown with the resize command
+	if _, ok := r.Options["size"]; ok && d.vdiExist(d.vdiName(r.Name)) == true {
+		err := errors.New("Volume already exists: " + r.Name + ", grow it with the resize command")
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
 	// Handle options (unrecognized options are silently ignored):
 	// size: If there is no explicit designation, use the value of
 	// config or default setting.
@@ -209,12 +457,94 @@ func (d SheepdogDriver) Create(r volume.Request) volume.Response {
 		opts["bsize"] = optsBsize
 	}
 
-	vdiname := d.Conf.VdiSuffix + "-" + r.Name
-	err := dogVdiCreate(vdiname, volumeSize, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort, opts)
-	if err != nil {
-		err := errors.New("Failed to create vdi")
-		log.Error(err)
-		return volume.Response{Err: err.Error()}
+	vopts := volumeOptions{
+		Name:      r.Name,
+		Namespace: d.Conf.Namespace,
+		Size:      volumeSize,
+		Copies:    opts["copies"],
+		Prealloc:  opts["prealloc"] == "true",
+		Hyper:     opts["hyper"] == "true",
+		Bsize:     opts["bsize"],
+	}
+
+	// fstype: filesystem to format the volume with on first mount
+	if optsFsType, ok := r.Options["fstype"]; ok {
+		if supportedFsTypes[optsFsType] == false {
+			err := errors.New("Unsupported fstype: " + optsFsType)
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		vopts.FsType = optsFsType
+	}
+
+	// mkfsopts: extra options passed to mkfs, limited to mkfsFlags
+	if optsMkfs, ok := r.Options["mkfsopts"]; ok {
+		fsType := vopts.FsType
+		if fsType == "" {
+			fsType = d.Conf.DefaultFsType
+		}
+		if err := checkMkfsOpts(fsType, optsMkfs); err != nil {
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		vopts.MkfsOpts = optsMkfs
+	}
+
+	// mountopts: options passed to mount, limited to AllowedMountOpts
+	if optsMount, ok := r.Options["mountopts"]; ok {
+		if err := d.checkMountOpts(optsMount); err != nil {
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		vopts.MountOpts = optsMount
+	}
+
+	// readonly: always mount the volume read-only
+	if ok := r.Options["readonly"]; ok == "true" {
+		vopts.ReadOnly = true
+	}
+
+	// label.<key>: free form labels kept with the volume
+	for k, v := range r.Options {
+		if strings.HasPrefix(k, labelPrefix) {
+			if vopts.Labels == nil {
+				vopts.Labels = make(map[string]string)
+			}
+			vopts.Labels[strings.TrimPrefix(k, labelPrefix)] = v
+		}
+	}
+
+	vdiname := d.vdiName(r.Name)
+	if optsFrom, ok := r.Options["from"]; ok {
+		// from: clone a snapshot (volume@tag) into a copy-on-write
+		// volume, size and the other options come from the snapshot
+		if err := d.createClone(r.Name, optsFrom); err != nil {
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+	} else {
+		size, _ := parseSize(volumeSize)
+		if err := d.checkQuota(vdiname, size); err != nil {
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		err := d.vdiCreate(vdiname, volumeSize, opts)
+		if err != nil {
+			log.Error("Error vdiCreate: ", err)
+			err := commandError("Failed to create vdi", err)
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		// a vdi without its options would not be in our namespace
+		if err := d.saveVolumeOptions(vdiname, vopts); err != nil {
+			log.Error("Failed to store volume options: ", err)
+			if err := d.vdiDelete(vdiname); err != nil {
+				log.Error("Error vdiDelete: ", err)
+			}
+			err := commandError("Failed to store volume options", err)
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
 	}
 
 	path := filepath.Join(d.Conf.MountPoint, r.Name)
@@ -228,19 +558,47 @@ func (d SheepdogDriver) Create(r volume.Request) volume.Response {
 // Remove API
 func (d SheepdogDriver) Remove(r volume.Request) volume.Response {
 	log.Infof("Remove: %s", r.Name)
+	d.lockChanges()
+	defer d.Mutex.Unlock()
 
-	log.Debug("Count %s", d.Conf.mountCount[r.Name])
-	if d.Conf.mountCount[r.Name] != 0 {
+	log.Debugf("Count %d", d.State.count(r.Name))
+	if d.State.count(r.Name) != 0 {
+		log.Debugf("Holders: %v", d.State.Volumes[r.Name].IDs)
 		err := errors.New("This volume is currently used by other container")
 		log.Error(err)
 		return volume.Response{Err: err.Error()}
 	}
-	delete(d.Conf.mountCount, r.Name)
+	if _, ok := d.State.Volumes[r.Name]; ok {
+		delete(d.State.Volumes, r.Name)
+		d.saveState()
+	}
 
-	vdiname := d.Conf.VdiSuffix + "-" + r.Name
-	err := dogVdiDelete(vdiname, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	vdiname := d.vdiName(r.Name)
+	if d.vdiExist(vdiname) == false {
+		if snap, ok, err := d.findSnapshot(r.Name); ok {
+			if err != nil {
+				log.Error(err)
+				return volume.Response{Err: err.Error()}
+			}
+			return d.removeSnapshot(snap)
+		}
+	}
+	if err := d.checkNamespace(d.readVolumeOptions(vdiname)); err != nil {
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	if lock, ok, err := d.readLock(vdiname); err != nil || (ok && lock.Host != d.Conf.Hostname) {
+		if err == nil {
+			err = errors.New("Volume is attached on host " + lock.Host)
+		}
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	err := d.vdiDelete(vdiname)
 	if err != nil {
-		err := errors.New("Failed to delete vdi")
+		log.Error("Error vdiDelete: ", err)
+		err := commandError("Failed to delete vdi", err)
 		log.Error(err)
 		return volume.Response{Err: err.Error()}
 	}
@@ -266,33 +624,61 @@ func (d SheepdogDriver) Path(r volume.Request) volume.Response {
 
 // Mount API
 func (d SheepdogDriver) Mount(r volume.MountRequest) volume.Response {
-	log.Infof("Mount: %s", r.Name)
-	d.Mutex.Lock()
+	log.Infof("Mount: %s (%s)", r.Name, r.ID)
+	d.lockChanges()
 	defer d.Mutex.Unlock()
 
 	// make sure that it is already mounting for another container
-	if isAlreadyMountingThisVolume(d.Conf.MountPoint+"/"+r.Name) == true {
+	if isAlreadyMountingThisVolume(d.Runner, d.Conf.MountPoint+"/"+r.Name) == true {
 		// already mounting
-		log.Debug("Mountpoint is already used: %s", r.Name)
-		d.Conf.mountCount[r.Name]++
-		log.Debug("Count %s", d.Conf.mountCount[r.Name])
+		log.Debugf("Mountpoint is already used: %s", r.Name)
+		if d.State.attach(r.Name, r.ID) == true {
+			d.saveState()
+		}
+		log.Debugf("Count %d", d.State.count(r.Name))
 		// skip all and return now
 		return volume.Response{Mountpoint: d.Conf.MountPoint + "/" + r.Name}
 	}
 	// double check
-	log.Debug("Count %s", d.Conf.mountCount[r.Name])
-	if d.Conf.mountCount[r.Name] != 0 {
-		log.Debug("Mountpoint is already used: %s", r.Name)
-		d.Conf.mountCount[r.Name]++
-		log.Debug("Count %s", d.Conf.mountCount[r.Name])
+	log.Debugf("Count %d", d.State.count(r.Name))
+	if d.State.count(r.Name) != 0 {
+		log.Debugf("Mountpoint is already used: %s", r.Name)
+		if d.State.attach(r.Name, r.ID) == true {
+			d.saveState()
+		}
+		log.Debugf("Count %d", d.State.count(r.Name))
 		return volume.Response{Mountpoint: d.Conf.MountPoint + "/" + r.Name}
 	}
 
 	// target new
 	log.Debug("create new lun")
-	lun := findVacantLun(d.Conf.TargetID)
+	lun := findVacantLun(d.Runner, d.Conf.TargetID)
 	log.Debug("lun: %s", lun)
-	vdiname := d.Conf.VdiSuffix + "-" + r.Name
+	vdiname := d.vdiName(r.Name)
+	if d.vdiExist(vdiname) == false {
+		err := errors.New("Volume Not Found")
+		if _, ok, _ := d.findSnapshot(r.Name); ok {
+			err = errors.New("Snapshot volumes can not be mounted")
+		}
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	vopts, err := d.readVolumeOptions(vdiname)
+	if err := d.checkNamespace(vopts, err); err != nil {
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	if err := d.checkMountOpts(vopts.MountOpts); err != nil {
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	// only one host may attach the vdi at a time
+	if err := d.lockVolume(vdiname); err != nil {
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
 
 	// Handle Remote Sheep Options
 	var bstore string
@@ -302,82 +688,143 @@ func (d SheepdogDriver) Mount(r volume.MountRequest) volume.Response {
 		bstore = "unix:" + d.Conf.LocalSheepSocket + ":" + vdiname
 	}
 
-	err := tgtLunNew(d.Conf.TargetID, lun, bstore)
+	err = d.retry("lun new", func() error {
+		return tgtLunNew(d.Runner, d.Conf.TargetID, lun, bstore)
+	})
 	if err != nil {
-		log.Fatal("Error create new lun: ", err)
+		log.Error("Error tgtLunNew: ", err)
+		// a timed out lun new may have created it
+		d.abortMount(vdiname, lun, "")
+		err := commandError("Failed to create lun", err)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
 	}
 
 	// iscsiadm -m session --rescan
 	log.Debug("rescan session")
-	iscsiRescan()
+	iscsiRescan(d.Runner)
 
 	// mapping disk
 	device := getDeviceNameFromLun(d.Conf.TargetBindIP, d.Conf.TargetBindPort, d.Conf.TargetIqn, lun)
-	realdevice := strings.TrimSpace(getDeviceFileFromIscsiPath(device))
+	realdevice := strings.TrimSpace(getDeviceFileFromIscsiPath(d.Runner, device))
 	log.Debug("realdevice: %s", realdevice)
+	if realdevice == "" {
+		d.abortMount(vdiname, lun, realdevice)
+		err := errors.New("Failed to find the device of lun " + lun)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
 
 	// mkfs
-	if getFSType(realdevice) == "" {
-		log.Debugf("Formatting device")
-		err := formatVolume(realdevice, "xfs")
+	if getFSType(d.Runner, realdevice) == "" {
+		if vopts.FsType == "" {
+			vopts.FsType = d.Conf.DefaultFsType
+		}
+		log.Debugf("Formatting device with %s", vopts.FsType)
+		err := formatVolume(d.Runner, realdevice, vopts.FsType, vopts.MkfsOpts)
 		if err != nil {
-			err := errors.New("Failed to format device")
+			d.abortMount(vdiname, lun, realdevice)
+			err := commandError("Failed to format device", err)
 			log.Error(err)
 			return volume.Response{Err: err.Error()}
 		}
 	}
 
 	// mount
-	if mountErr := mount(realdevice, d.Conf.MountPoint+"/"+r.Name); mountErr != nil {
-		err := errors.New("Problem mounting docker volume ")
+	if mountErr := mount(d.Runner, realdevice, d.Conf.MountPoint+"/"+r.Name, vopts.mountOptions()); mountErr != nil {
+		d.abortMount(vdiname, lun, realdevice)
+		err := commandError("Problem mounting docker volume", mountErr)
 		log.Error(err)
 		return volume.Response{Err: err.Error()}
 	}
 
-	log.Debug("Count %s", d.Conf.mountCount[r.Name])
-	d.Conf.mountCount[r.Name]++
-	log.Debug("Count %s", d.Conf.mountCount[r.Name])
+	// the vdi may have been resized while it was not mounted
+	if vopts.ReadOnly == false {
+		if err := growFilesystem(d.Runner, realdevice, d.Conf.MountPoint+"/"+r.Name, getFSType(d.Runner, realdevice)); err != nil {
+			log.Warning("Failed to grow filesystem: ", err)
+		}
+	}
+
+	d.State.Volumes[r.Name] = &volumeState{Lun: lun, Device: realdevice, IDs: map[string]bool{r.ID: true}}
+	d.saveState()
+	log.Debugf("Count %d", d.State.count(r.Name))
 
 	return volume.Response{Mountpoint: d.Conf.MountPoint + "/" + r.Name}
 }
 
+// abortMount removes the device and the lun of a failed Mount, or of
+// a volume Unmount finds unmounted, and releases the lock. The lock is kept while the lun is still there,
+// the vdi must not be attached by another host.
+func (d SheepdogDriver) abortMount(vdiname, lun, device string) {
+	if device != "" {
+		if err := iscsiDeleteDevice(d.Runner, strings.TrimPrefix(device, "/dev/")); err != nil {
+			log.Warning("Failed to delete device: ", err)
+		}
+	}
+	err := tgtLunDelete(d.Runner, d.Conf.TargetID, lun)
+	iscsiRescan(d.Runner)
+	if err != nil {
+		log.Errorf("Failed to delete lun %s, keeping the lock of %s: %v", lun, vdiname, err)
+		return
+	}
+	d.unlockVolume(vdiname)
+}
+
 // Unmount API
 func (d SheepdogDriver) Unmount(r volume.UnmountRequest) volume.Response {
-	log.Infof("Unmount: %s", r.Name)
-	d.Mutex.Lock()
+	log.Infof("Unmount: %s (%s)", r.Name, r.ID)
+	d.lockChanges()
 	defer d.Mutex.Unlock()
 
-	log.Debug("Count %s", d.Conf.mountCount[r.Name])
-	d.Conf.mountCount[r.Name]--
-	log.Debug("Count %s", d.Conf.mountCount[r.Name])
+	released := d.State.detach(r.Name, r.ID)
+	vs := d.State.volume(r.Name)
+	log.Debugf("Count %d", len(vs.IDs))
 
-	lun := getLunFromDeviceName(r.Name)
-	scsi := getScsiNameFromDeviceName(r.Name)
+	if len(vs.IDs) == 0 {
+		lun := vs.Lun
+		if lun == "" {
+			lun = getLunFromDeviceName(d.Runner, filepath.Join(d.Conf.MountPoint, r.Name))
+		}
+		scsi := strings.TrimPrefix(vs.Device, "/dev/")
+		if scsi == "" {
+			scsi = getScsiNameFromDeviceName(d.Runner, filepath.Join(d.Conf.MountPoint, r.Name))
+		}
 
-	if d.Conf.mountCount[r.Name] <= 0 {
-		if umountErr := umount(d.Conf.MountPoint + "/" + r.Name); umountErr != nil {
+		if umountErr := umount(d.Runner, d.Conf.MountPoint+"/"+r.Name); umountErr != nil {
 			if umountErr.Error() == "Volume is not mounted" {
 				log.Warning("Request to unmount volume, but it's not mounted")
+				// the LUN and the device of a failed mount may be left,
+				// the lock is kept while they are
+				if lun != "" {
+					d.abortMount(d.vdiName(r.Name), lun, scsi)
+				} else {
+					d.unlockVolume(d.vdiName(r.Name))
+				}
+				delete(d.State.Volumes, r.Name)
+				d.saveState()
 				return volume.Response{}
 			}
+			if released == true {
+				vs.IDs[r.ID] = true
+			}
 			return volume.Response{Err: umountErr.Error()}
 		}
 
-		err := iscsiDeleteDevice(scsi)
+		err := iscsiDeleteDevice(d.Runner, scsi)
 		if err != nil {
 			log.Debug("Error unit.iscsiDeleteDevice: ", err)
 		}
 
-		err = tgtLunDelete(d.Conf.TargetID, lun)
+		err = tgtLunDelete(d.Runner, d.Conf.TargetID, lun)
 		if err != nil {
 			log.Debug("Error unit.tgtLunDelete: ", err)
 		}
 
-		iscsiRescan()
+		iscsiRescan(d.Runner)
+		d.unlockVolume(d.vdiName(r.Name))
 
-		log.Debug("Count %s", d.Conf.mountCount[r.Name])
-		d.Conf.mountCount[r.Name] = 0
-		log.Debug("Count %s", d.Conf.mountCount[r.Name])
+		delete(d.State.Volumes, r.Name)
+		d.saveState()
 
 		path := filepath.Join(d.Conf.MountPoint, r.Name)
 		_, err = os.Stat(path)
@@ -388,6 +835,12 @@ func (d SheepdogDriver) Unmount(r volume.UnmountRequest) volume.Response {
 				return volume.Response{Err: err.Error()}
 			}
 		}
+		return volume.Response{}
+	}
+	if released == true {
+		d.saveState()
+	} else {
+		log.Debugf("%s was not holding %s, nothing to do", r.ID, r.Name)
 	}
 	return volume.Response{}
 }
@@ -395,13 +848,28 @@ func (d SheepdogDriver) Unmount(r volume.UnmountRequest) volume.Response {
 // Get API
 func (d SheepdogDriver) Get(r volume.Request) volume.Response {
 	log.Infof("Get: %s", r.Name)
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+
 	path := filepath.Join(d.Conf.MountPoint, r.Name)
 	log.Infof("Get path: %s", path)
 
-	vdiname := d.Conf.VdiSuffix + "-" + r.Name
-	vdiexist := dogVdiExist(vdiname, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	vdiname := d.vdiName(r.Name)
+	vdiexist := d.vdiExist(vdiname)
 	if vdiexist == true {
-		return volume.Response{Volume: &volume.Volume{Name: r.Name, Mountpoint: path}}
+		if err := d.checkNamespace(d.readVolumeOptions(vdiname)); err != nil {
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		vol := &volume.Volume{Name: r.Name, Mountpoint: path, Status: d.volumeStatus(r.Name, vdiname)}
+		return volume.Response{Volume: vol}
+	}
+	if snap, ok, err := d.findSnapshot(r.Name); ok {
+		if err != nil {
+			log.Error(err)
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{Volume: d.snapshotVolume(snap)}
 	}
 
 	log.Debugf("Failed to retrieve volume named: ", r.Name)
@@ -421,15 +889,23 @@ func (d SheepdogDriver) List(r volume.Request) volume.Response {
 		return volume.Response{}
 	}
 
-	out := dogVdiList(d.Conf.VdiSuffix, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
-	for _, line := range strings.Split(string(out), "\n") {
-		if strings.Contains(line, d.Conf.VdiSuffix) {
-			searchname := d.Conf.VdiSuffix + "-"
-			volname := strings.Replace(line, searchname, "", -1)
-			vol := &volume.Volume{Name: volname, Mountpoint: (path + "/" + volname)}
-			vols = append(vols, vol)
-			log.Debug("vol: %s", vol)
+	// the options are only shown by Get, listing reads them from the cache
+	vdis, err := d.ownVdis()
+	if err != nil {
+		err := commandError("Failed to list vdi", err)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	for _, o := range vdis {
+		if o.Snapshot == true || d.checkNamespace(o.Options, o.OptionsErr) != nil {
+			continue
 		}
+		vol := &volume.Volume{Name: o.Volume, Mountpoint: (path + "/" + o.Volume)}
+		vols = append(vols, vol)
+		log.Debug("vol: %s", vol)
+	}
+	for _, snap := range d.snapshotsOf(vdis) {
+		vols = append(vols, d.snapshotVolume(snap))
 	}
 
 	return volume.Response{Volumes: vols}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	testListing = "= dvp-vol1 0 1073741824 4194304 0 1507000000 7c2b25 3  22\n" +
+		"s dvp-vol1 1 1073741824 0 4194304 1506000000 7c2b24 3 snap1 22\n"
+	testTarget = "Target 1: iqn.2017-09.org.sheepdog-docker\n" +
+		"    LUN: 0\n" +
+		"        Type: controller\n"
+	testByPath = "lrwxrwxrwx 1 root root 9 Oct  3 00:00 " +
+		"/dev/disk/by-path/ip-127.0.0.1:3260-iscsi-iqn.2017-09.org.sheepdog-docker-lun-1 -> ../../sdtest\n"
+)
+
+func init() {
+	// the by-path link of the fake LUN never shows up
+	detectDeviceTries = 0
+}
+
+// newTestDriver loads a driver running its commands with f,
+// with its mount point and state in a temporary directory
+func newTestDriver(t *testing.T, f *fakeRunner) (SheepdogDriver, string) {
+	dir, err := ioutil.TempDir("", "dvp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(dir, "config.json")
+	content := `{"MountPoint": "` + mnt + `", "StateDir": "` + filepath.Join(dir, "state") + `",
+		"Hostname": "host1", "Retries": {"default": {"Attempts": 1}}}`
+	if err := ioutil.WriteFile(cfg, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return loadSheepdogDriver(cfg, f), dir
+}
+
+// mountable scripts a vol1 vdi which can be attached as lun 1 on /dev/sdtest,
+// its attach lock reads as held by this host
+func mountable(f *fakeRunner, mnt string) {
+	f.on("getattr dvp-vol1 dvp.lock", `{"Host":"host1","Time":"2017-10-03T00:00:00Z"}`)
+	f.on("vdi list -r", testListing)
+	f.on("--op show", testTarget)
+	f.on("ls -la", testByPath)
+	f.on("--output HCTL", `HCTL="12:0:0:1" TRAN="iscsi" MOUNTPOINT="`+mnt+`"`)
+	f.on("--output NAME", `NAME="sdtest" TRAN="iscsi" MOUNTPOINT="`+mnt+`"`)
+}
+
+// expectCalls fails when no command line contains one of the patterns
+func expectCalls(t *testing.T, f *fakeRunner, patterns ...string) {
+	for _, pattern := range patterns {
+		if len(f.called(pattern)) == 0 {
+			t.Errorf("no command with %q in %q", pattern, f.calls)
+		}
+	}
+}
+
+func TestDriverLifecycle(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	mnt := filepath.Join(dir, "mnt", "vol1")
+
+	// Create
+	r := d.Create(volume.Request{Name: "vol1", Options: map[string]string{"size": "1G", "copies": "3"}})
+	if r.Err != "" {
+		t.Fatal("Create: ", r.Err)
+	}
+	expectCalls(t, f, "dog vdi create -v --copies 3 dvp-vol1 1G")
+	if _, err := os.Stat(mnt); err != nil {
+		t.Error("mount directory: ", err)
+	}
+
+	// List
+	mountable(f, mnt)
+	r = d.List(volume.Request{})
+	if r.Err != "" {
+		t.Fatal("List: ", r.Err)
+	}
+	if len(r.Volumes) != 2 || r.Volumes[0].Name != "vol1" || r.Volumes[0].Mountpoint != mnt || r.Volumes[1].Name != "snap1" {
+		t.Fatalf("List: %+v", r.Volumes)
+	}
+
+	// Mount, formatting the new vdi
+	f.reset()
+	f.onceFail("blkid", "")
+	f.on("blkid", `/dev/sdtest: UUID="0a0b" TYPE="xfs"`)
+	r = d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"})
+	if r.Err != "" {
+		t.Fatal("Mount: ", r.Err)
+	}
+	if r.Mountpoint != mnt {
+		t.Errorf("Mount: mountpoint %s", r.Mountpoint)
+	}
+	expectCalls(t, f,
+		"--op new --tid 1 --lun 1 --bstype sheepdog --backing-store unix:/var/lib/sheepdog/sock:dvp-vol1",
+		"setattr -x dvp-vol1 dvp.lock {\"Host\":\"host1\"",
+		"mkfs.xfs -f /dev/sdtest",
+		"mount /dev/sdtest "+mnt)
+
+	// a second container shares the mount
+	f.on("--output MOUNTPOINT", `MOUNTPOINT="`+mnt+`"`)
+	f.reset()
+	if r = d.Mount(volume.MountRequest{Name: "vol1", ID: "c2"}); r.Err != "" || r.Mountpoint != mnt {
+		t.Fatalf("Mount again: %+v", r)
+	}
+	if len(f.called("--op new")) != 0 {
+		t.Errorf("Mount again: %q", f.calls)
+	}
+	if vs := d.State.Volumes["vol1"]; vs == nil || vs.Lun != "1" || vs.Device != "/dev/sdtest" || len(vs.IDs) != 2 {
+		t.Errorf("Mount: state %+v", vs)
+	}
+	// a restarted plugin knows the volume is attached
+	restore := fakeMountInfo(t, dir, mnt)
+	rf := &fakeRunner{}
+	rf.on("--op show", tgtShow(map[string]string{"1": "unix:/var/lib/sheepdog/sock:dvp-vol1"}))
+	restarted := loadSheepdogDriver(filepath.Join(dir, "config.json"), rf)
+	restarted.reconcile()
+	restore()
+	if restarted.State.count("vol1") != 2 {
+		t.Errorf("restarted: state %+v", restarted.State.Volumes)
+	}
+
+	// Get
+	r = d.Get(volume.Request{Name: "vol1"})
+	if r.Err != "" {
+		t.Fatal("Get: ", r.Err)
+	}
+	status := r.Volume.Status
+	if r.Volume.Name != "vol1" || r.Volume.Mountpoint != mnt {
+		t.Errorf("Get: %+v", r.Volume)
+	}
+	if status["Vdi"] != "dvp-vol1" || status["Size"] != uint64(1073741824) || status["Snapshots"] != 1 || status["Redundancy"] != "3" {
+		t.Errorf("Get: vdi status %v", status)
+	}
+	if status["Attached"] != true || status["Lun"] != "1" || status["Device"] != "/dev/sdtest" || status["MountCount"] != 2 {
+		t.Errorf("Get: attach status %v", status)
+	}
+
+	// Remove refuses a volume in use
+	if r = d.Remove(volume.Request{Name: "vol1"}); r.Err == "" {
+		t.Error("Remove of a mounted volume succeeded")
+	}
+
+	// Unmount, the last one detaches the vdi
+	f.reset()
+	if r = d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Unmount: ", r.Err)
+	}
+	if len(f.called("umount")) != 0 {
+		t.Errorf("Unmount of a shared volume: %q", f.calls)
+	}
+	if r = d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c2"}); r.Err != "" {
+		t.Fatal("Unmount: ", r.Err)
+	}
+	expectCalls(t, f, "umount "+mnt, "--op delete --tid 1 --lun 1", "setattr -d dvp-vol1 dvp.lock")
+	if _, err := os.Stat(mnt); os.IsNotExist(err) == false {
+		t.Error("mount directory left: ", err)
+	}
+	if _, ok := d.State.Volumes["vol1"]; ok {
+		t.Errorf("Unmount: state %+v", d.State.Volumes["vol1"])
+	}
+
+	// Remove
+	f.reset()
+	if r = d.Remove(volume.Request{Name: "vol1"}); r.Err != "" {
+		t.Fatal("Remove: ", r.Err)
+	}
+	expectCalls(t, f, "dog vdi delete dvp-vol1")
+}
+
+func TestDriverCreateFailure(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	f.fail("dog vdi create", "Failed to connect to 127.0.0.1:7000")
+	if r := d.Create(volume.Request{Name: "vol1"}); r.Err != "Failed to create vdi" {
+		t.Errorf("Create: %+v", r)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mnt", "vol1")); os.IsNotExist(err) == false {
+		t.Error("mount directory created: ", err)
+	}
+}
+
+func TestDriverMountFormatFailure(t *testing.T) {
+	for _, lunDeleted := range []bool{true, false} {
+		f := &fakeRunner{}
+		d, dir := newTestDriver(t, f)
+
+		mountable(f, filepath.Join(dir, "mnt", "vol1"))
+		f.fail("mkfs.xfs", "mkfs.xfs: no space left on device")
+		if lunDeleted == false {
+			f.fail("--op delete", "tgtadm: this logical unit is still active")
+		}
+		if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "Failed to format device" {
+			t.Errorf("Mount: %+v", r)
+		}
+		if len(f.called("sudo mount")) != 0 {
+			t.Errorf("mounted an unformatted device: %q", f.calls)
+		}
+		expectCalls(t, f, "--op delete --tid 1 --lun 1")
+		// the lock is kept while the lun is there
+		if unlocked := len(f.called("setattr -d dvp-vol1 dvp.lock")) != 0; unlocked != lunDeleted {
+			t.Errorf("lun deleted %v, lock released %v", lunDeleted, unlocked)
+		}
+		if _, ok := d.State.Volumes["vol1"]; ok {
+			t.Errorf("Mount: state %+v", d.State.Volumes["vol1"])
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDriverMountNoDevice(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	mountable(f, filepath.Join(dir, "mnt", "vol1"))
+	f.fail("ls -la", "ls: cannot access: No such file or directory")
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "Failed to find the device of lun 1" {
+		t.Errorf("Mount: %+v", r)
+	}
+	expectCalls(t, f, "--op delete --tid 1 --lun 1", "setattr -d dvp-vol1 dvp.lock")
+	if len(f.called("mount /dev")) != 0 {
+		t.Errorf("mounted without a device: %q", f.calls)
+	}
+}
+
+func TestDriverMountLunFailure(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	mountable(f, filepath.Join(dir, "mnt", "vol1"))
+	f.fail("--op new", "tgtadm: out of memory")
+	f.fail("--op delete", "tgtadm: can't find the logical unit")
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err == "" {
+		t.Fatal("Mount succeeded")
+	}
+	// a lun which was not created is taken as deleted
+	expectCalls(t, f, "--op delete --tid 1 --lun 1", "setattr -d dvp-vol1 dvp.lock")
+}
+
+func TestDriverUnmountNotMounted(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	mnt := filepath.Join(dir, "mnt", "vol1")
+
+	mountable(f, mnt)
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Mount: ", r.Err)
+	}
+	// unmounted behind the plugin: the lun and the device are removed
+	// before the lock is released
+	f.fail("sudo umount", "umount: "+mnt+": not mounted")
+	f.reset()
+	if r := d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Unmount: ", r.Err)
+	}
+	expectCalls(t, f, "--op delete --tid 1 --lun 1", "setattr -d dvp-vol1 dvp.lock")
+
+	// the lock is kept while the lun is there
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Mount: ", r.Err)
+	}
+	f.fail("--op delete", "tgtadm: this logical unit is still active")
+	f.reset()
+	d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"})
+	if len(f.called("setattr -d")) != 0 {
+		t.Errorf("released the lock of an attached lun: %q", f.calls)
+	}
+}
+
+func TestDriverGetNotFound(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	if r := d.Get(volume.Request{Name: "vol1"}); r.Err != "Volume Not Found" {
+		t.Errorf("Get: %+v", r)
+	}
+}
+
+func TestDriverMountIDs(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	mnt := filepath.Join(dir, "mnt", "vol1")
+
+	mountable(f, mnt)
+	f.on("blkid", `/dev/sdtest: UUID="0a0b" TYPE="xfs"`)
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Mount: ", r.Err)
+	}
+	// a retried Mount for the same ID is not another holder
+	f.on("--output MOUNTPOINT", `MOUNTPOINT="`+mnt+`"`)
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Mount again: ", r.Err)
+	}
+	if d.State.count("vol1") != 1 {
+		t.Errorf("Mount again: holders %v", d.State.Volumes["vol1"].IDs)
+	}
+
+	// an ID not holding the volume releases nothing
+	f.reset()
+	if r := d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c2"}); r.Err != "" {
+		t.Fatal("Unmount: ", r.Err)
+	}
+	if len(f.called("umount")) != 0 || d.State.count("vol1") != 1 {
+		t.Errorf("Unmount of an unknown ID: %q", f.calls)
+	}
+	if r := d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Unmount: ", r.Err)
+	}
+	expectCalls(t, f, "umount "+mnt, "--op delete --tid 1 --lun 1")
+
+	// a duplicated Unmount is a no-op
+	f.fail("sudo umount", "umount: "+mnt+": not mounted")
+	f.on("--output HCTL", `HCTL="12:0:0:1" TRAN="iscsi" MOUNTPOINT=""`)
+	f.on("--output NAME", `NAME="sdtest" TRAN="iscsi" MOUNTPOINT=""`)
+	f.reset()
+	if r := d.Unmount(volume.UnmountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Unmount again: ", r.Err)
+	}
+	if len(f.called("--op delete")) != 0 {
+		t.Errorf("Unmount again: %q", f.calls)
+	}
+}
+
+func TestDriverCreateOptionsFailure(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	f.fail("setattr dvp-vol1 dvp.options", "failed to set attribute")
+	if r := d.Create(volume.Request{Name: "vol1"}); r.Err == "" {
+		t.Fatal("Create succeeded without its options")
+	}
+	expectCalls(t, f, "dog vdi delete dvp-vol1")
+}
+
+func TestDriverMountLocked(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	// attached on another host
+	mountable(f, filepath.Join(dir, "mnt", "vol1"))
+	f.fail("setattr -x dvp-vol1 dvp.lock", "Failed to set attribute: VDI attribute exists")
+	f.on("getattr dvp-vol1 dvp.lock", `{"Host":"host2","Time":"2017-10-03T00:00:00Z"}`)
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); strings.HasPrefix(r.Err, "Volume is attached on host host2") == false {
+		t.Errorf("Mount: %+v", r)
+	}
+	if len(f.called("--op new")) != 0 || d.State.count("vol1") != 0 {
+		t.Errorf("Mount of a locked volume: %q", f.calls)
+	}
+	if r := d.Remove(volume.Request{Name: "vol1"}); r.Err != "Volume is attached on host host2" {
+		t.Errorf("Remove: %+v", r)
+	}
+	if len(f.called("vdi delete")) != 0 {
+		t.Errorf("Remove of a locked volume: %q", f.calls)
+	}
+
+	// a lock left behind by this host is taken over
+	f.on("getattr dvp-vol1 dvp.lock", `{"Host":"host1","Time":"2017-10-03T00:00:00Z"}`)
+	f.on("setattr -x dvp-vol1 dvp.lock", "")
+	f.onceFail("setattr -x dvp-vol1 dvp.lock", "Failed to set attribute: VDI attribute exists")
+	f.on("blkid", `/dev/sdtest: UUID="0a0b" TYPE="xfs"`)
+	f.reset()
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "" {
+		t.Fatal("Mount: ", r.Err)
+	}
+	expectCalls(t, f, "setattr -d dvp-vol1 dvp.lock", "--op new --tid 1 --lun 1")
+	if n := len(f.called("setattr -x dvp-vol1 dvp.lock {\"Host\":\"host1\"")); n != 2 {
+		t.Errorf("Mount: %d exclusive setattr", n)
+	}
+}
+
+func TestDriverCreateInvalid(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	for _, r := range []volume.Request{
+		{Name: "../vol1"},
+		{Name: "vol1;reboot"},
+		{Name: "vol1", Options: map[string]string{"size": "1G; reboot"}},
+		{Name: "vol1", Options: map[string]string{"prealloc": "yes"}},
+		{Name: "vol1", Options: map[string]string{"bsize": "40"}},
+		{Name: "vol1", Options: map[string]string{"from": "vol2@-s"}},
+		{Name: "vol1", Options: map[string]string{"mkfsopts": "-f /dev/sda"}},
+		{Name: "vol1", Options: map[string]string{"fstype": "ntfs"}},
+		{Name: "vol1", Options: map[string]string{"mountopts": "exec"}},
+	} {
+		if resp := d.Create(r); resp.Err == "" {
+			t.Errorf("Create %s %v succeeded", r.Name, r.Options)
+		}
+	}
+	if len(f.called("vdi create")) != 0 || len(f.called("setattr")) != 0 {
+		t.Errorf("commands run: %q", f.calls)
+	}
+}
+
+func TestDriverNamespace(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	// vol1 was created by the plugin of another namespace
+	mountable(f, filepath.Join(dir, "mnt", "vol1"))
+	f.on("getattr dvp-vol1 dvp.options", `{"Name":"vol1","Namespace":"team"}`)
+
+	if r := d.List(volume.Request{}); r.Err != "" || len(r.Volumes) != 0 {
+		t.Errorf("List: %+v", r)
+	}
+	if r := d.Get(volume.Request{Name: "vol1"}); r.Err != "Volume belongs to another namespace" {
+		t.Errorf("Get: %+v", r)
+	}
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err != "Volume belongs to another namespace" {
+		t.Errorf("Mount: %+v", r)
+	}
+	if r := d.Remove(volume.Request{Name: "vol1"}); r.Err != "Volume belongs to another namespace" {
+		t.Errorf("Remove: %+v", r)
+	}
+	if r := d.Create(volume.Request{Name: "vol2", Options: map[string]string{"namespace": "team"}}); r.Err == "" {
+		t.Error("Create in another namespace succeeded")
+	}
+	if len(f.called("--op new")) != 0 || len(f.called("vdi delete")) != 0 || len(f.called("vdi create")) != 0 {
+		t.Errorf("commands run: %q", f.calls)
+	}
+
+	// options which can not be read do not make it ours
+	f.fail("getattr dvp-vol1 dvp.options", "Failed to connect to 127.0.0.1:7000")
+	if r := d.Mount(volume.MountRequest{Name: "vol1", ID: "c1"}); r.Err == "" {
+		t.Error("Mount without options succeeded")
+	}
+	if r := d.Remove(volume.Request{Name: "vol1"}); r.Err == "" {
+		t.Error("Remove without options succeeded")
+	}
+	if len(f.called("--op new")) != 0 || len(f.called("vdi delete")) != 0 {
+		t.Errorf("commands run: %q", f.calls)
+	}
+}
+
+func TestDriverListFailure(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	f.fail("vdi list -r", "failed to connect to 127.0.0.1:7000: Connection refused")
+	if r := d.List(volume.Request{}); r.Err == "" || len(r.Volumes) != 0 {
+		t.Errorf("List: %+v", r)
+	}
+}
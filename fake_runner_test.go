@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// fakeRule answers the command lines containing pattern
+type fakeRule struct {
+	pattern string
+	out     string
+	fails   bool
+	// calls the rule answers before it is used up, 0 for no limit
+	times int
+}
+
+// fakeRunner stands in for the host commands: it replays the canned
+// output of dog, tgtadm, iscsiadm, lsblk, blkid ... and records every
+// command line it is given. The rules added with once are tried first,
+// in order, then the others. A command no rule matches succeeds without
+// output, which is also how an unset vdi attribute reads.
+type fakeRunner struct {
+	mu    sync.Mutex
+	once  []*fakeRule
+	rules []*fakeRule
+	calls []string
+}
+
+// on answers out to the commands containing pattern,
+// replacing the previous answer for pattern
+func (f *fakeRunner) on(pattern, out string) {
+	f.set(&fakeRule{pattern: pattern, out: out})
+}
+
+// fail makes the commands containing pattern exit with an error and out
+func (f *fakeRunner) fail(pattern, out string) {
+	f.set(&fakeRule{pattern: pattern, out: out, fails: true})
+}
+
+func (f *fakeRunner) set(rule *fakeRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, r := range f.rules {
+		if r.pattern == rule.pattern {
+			f.rules[i] = rule
+			return
+		}
+	}
+	f.rules = append(f.rules, rule)
+}
+
+// onceFail makes the next command containing pattern fail with out
+func (f *fakeRunner) onceFail(pattern, out string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.once = append(f.once, &fakeRule{pattern: pattern, out: out, fails: true, times: 1})
+}
+
+// Run records the command line and answers it from the rules
+func (f *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, line)
+
+	rule := f.match(line)
+	if rule == nil {
+		return nil, nil
+	}
+	if rule.fails == true {
+		err := &CommandError{Command: commandLabel(name, args), Output: rule.out, Err: errors.New("exit status 1")}
+		return []byte(rule.out), err
+	}
+	return []byte(rule.out), nil
+}
+
+func (f *fakeRunner) match(line string) *fakeRule {
+	for i, r := range f.once {
+		if strings.Contains(line, r.pattern) {
+			if r.times--; r.times == 0 {
+				f.once = append(f.once[:i], f.once[i+1:]...)
+			}
+			return r
+		}
+	}
+	for _, r := range f.rules {
+		if strings.Contains(line, r.pattern) {
+			return r
+		}
+	}
+	return nil
+}
+
+// called returns the recorded command lines containing pattern
+func (f *fakeRunner) called(pattern string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var lines []string
+	for _, line := range f.calls {
+		if strings.Contains(line, pattern) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// reset forgets the recorded command lines
+func (f *fakeRunner) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// vdi attribute holding the attach lock of a volume
+const lockAttr = "dvp.lock"
+
+// defaultLockTimeout is used when LockTimeout is not set
+const defaultLockTimeout = 2 * time.Minute
+
+// attachLock records the host a volume is attached on.
+// Only that host may attach the volume until it releases the lock,
+// so two hosts never mount the same vdi at once.
+// The holder renews Time periodically, a lock which is not renewed
+// within LockTimeout can be taken over by another host.
+type attachLock struct {
+	Host string
+	Time time.Time
+
+	// value of the attribute as read
+	raw string
+}
+
+// lockTable keeps the locks held by this host, which the heartbeat
+// renews, and when the locks of other hosts were last seen changing.
+// It has a mutex of its own, the heartbeat never waits for the driver
+// mutex held by long requests.
+type lockTable struct {
+	mu   sync.Mutex
+	held map[string]bool
+	seen map[string]lockSighting
+}
+
+// lockSighting is a lock value of another host and when it was first seen
+type lockSighting struct {
+	raw   string
+	since time.Time
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{held: make(map[string]bool), seen: make(map[string]lockSighting)}
+}
+
+// readLock returns the attach lock of vdiname, ok is false when unlocked.
+// A lock which can not be read or parsed is an error, it must not be
+// mistaken for a free or an expired one.
+func (d SheepdogDriver) readLock(vdiname string) (lock attachLock, ok bool, err error) {
+	value, err := dogVdiGetattr(d.Runner, vdiname, lockAttr, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err == errAttrNotFound || (err == nil && value == "") {
+		return lock, false, nil
+	}
+	if err != nil {
+		return lock, false, err
+	}
+	if err := json.Unmarshal([]byte(value), &lock); err != nil || lock.Host == "" {
+		log.Errorf("Failed to parse the lock of %s: %q", vdiname, value)
+		return lock, true, errors.New("Lock of " + vdiname + " can not be parsed, break it if no host uses the volume")
+	}
+	lock.raw = value
+	return lock, true, nil
+}
+
+// lockTimeout is how long a lock stays valid without being renewed
+func (d SheepdogDriver) lockTimeout() time.Duration {
+	timeout, err := time.ParseDuration(d.Conf.LockTimeout)
+	if err != nil {
+		return defaultLockTimeout
+	}
+	return timeout
+}
+
+// expired reports whether the holder of lock stopped renewing it, most
+// likely because the host or its plugin died. The Time of the holder is
+// not compared with our clock, which may be skewed: the lock expires once
+// this host has seen the same value for longer than the timeout.
+// d.Locks.mu is held by the caller.
+func (d SheepdogDriver) expired(vdiname string, lock attachLock) bool {
+	t := d.Locks
+	if t == nil {
+		return false
+	}
+	seen, ok := t.seen[vdiname]
+	if ok == false || seen.raw != lock.raw {
+		t.seen[vdiname] = lockSighting{raw: lock.raw, since: time.Now()}
+		return false
+	}
+	return time.Since(seen.since) > d.lockTimeout()
+}
+
+// writeLock sets the lock of vdiname to this host and the current time
+func (d SheepdogDriver) writeLock(vdiname string, exclusive bool) error {
+	value, err := json.Marshal(attachLock{Host: d.Conf.Hostname, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	if exclusive == true {
+		return dogVdiSetattrExclusive(d.Runner, vdiname, lockAttr, string(value), d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	}
+	return dogVdiSetattr(d.Runner, vdiname, lockAttr, string(value), d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+}
+
+// lockVolume takes the attach lock of vdiname for this host.
+// A lock already held by this host, e.g. left over from a crash,
+// or an expired lock of another host is taken over.
+func (d SheepdogDriver) lockVolume(vdiname string) error {
+	if d.Locks != nil {
+		d.Locks.mu.Lock()
+		defer d.Locks.mu.Unlock()
+	}
+	if err := d.writeLock(vdiname, true); err == nil {
+		d.Locks.hold(vdiname)
+		return nil
+	} else if _, ok := err.(*TimeoutError); ok {
+		// the lock may or may not be ours now, the next Mount finds out
+		log.Error("Error dogVdiSetattrExclusive: ", err)
+		return commandError("Failed to lock vdi", err)
+	}
+
+	held, ok, err := d.readLock(vdiname)
+	if err != nil {
+		log.Error("Error readLock: ", err)
+		return err
+	}
+	if ok == false {
+		return errors.New("Failed to lock vdi")
+	}
+	if held.Host == d.Conf.Hostname {
+		log.Infof("Taking over the lock of %s held by this host since %s", vdiname, held.Time.Format(time.RFC3339))
+	} else if d.expired(vdiname, held) == true {
+		log.Warningf("Taking over the expired lock of %s held by %s since %s", vdiname, held.Host, held.Time.Format(time.RFC3339))
+	} else {
+		return errors.New("Volume is attached on host " + held.Host + ", its lock expires when not renewed for " + d.Conf.LockTimeout)
+	}
+
+	// compare and swap: the lock is deleted only while it still has the
+	// value seen, then taken exclusively. Of the hosts taking it over at
+	// once, only one gets it.
+	current, ok, err := d.readLock(vdiname)
+	if err != nil || ok == false || current.raw != held.raw {
+		return errors.New("Lock of " + vdiname + " changed while taking it over")
+	}
+	if err := dogVdiDelattr(d.Runner, vdiname, lockAttr, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort); err != nil {
+		log.Error("Error dogVdiDelattr: ", err)
+		return errors.New("Failed to lock vdi")
+	}
+	if err := d.writeLock(vdiname, true); err != nil {
+		log.Error("Error dogVdiSetattrExclusive: ", err)
+		return errors.New("Lost the lock of " + vdiname + " to another host")
+	}
+	// a host which read the old value as well may have deleted ours
+	current, ok, err = d.readLock(vdiname)
+	if err != nil || ok == false || current.Host != d.Conf.Hostname {
+		return errors.New("Lost the lock of " + vdiname + " to another host")
+	}
+	d.Locks.hold(vdiname)
+	return nil
+}
+
+// hold adds vdiname to the locks renewed by the heartbeat, t.mu is held
+func (t *lockTable) hold(vdiname string) {
+	if t == nil {
+		return
+	}
+	t.held[vdiname] = true
+	delete(t.seen, vdiname)
+}
+
+// unlockVolume releases the attach lock of vdiname if this host holds it
+func (d SheepdogDriver) unlockVolume(vdiname string) {
+	if d.Locks != nil {
+		d.Locks.mu.Lock()
+		defer d.Locks.mu.Unlock()
+		delete(d.Locks.held, vdiname)
+	}
+	held, ok, err := d.readLock(vdiname)
+	if err != nil {
+		log.Error("Not releasing the lock of ", vdiname, ": ", err)
+		return
+	}
+	if ok == false {
+		return
+	}
+	if held.Host != d.Conf.Hostname {
+		log.Warningf("Not releasing the lock of %s held by %s", vdiname, held.Host)
+		return
+	}
+	if err := dogVdiDelattr(d.Runner, vdiname, lockAttr, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort); err != nil {
+		log.Error("Failed to release the lock of ", vdiname, ": ", err)
+	}
+}
+
+// adoptLock renews the lock of vdiname, attached on this host
+// before the plugin started
+func (d SheepdogDriver) adoptLock(vdiname string) {
+	if d.Locks == nil {
+		return
+	}
+	d.Locks.mu.Lock()
+	d.Locks.hold(vdiname)
+	d.Locks.mu.Unlock()
+	d.renewLock(vdiname)
+}
+
+// renewLocks refreshes the locks held by this host
+func (d SheepdogDriver) renewLocks() {
+	if d.Locks == nil {
+		return
+	}
+	d.Locks.mu.Lock()
+	var vdis []string
+	for vdiname := range d.Locks.held {
+		vdis = append(vdis, vdiname)
+	}
+	d.Locks.mu.Unlock()
+
+	for _, vdiname := range vdis {
+		d.renewLock(vdiname)
+	}
+}
+
+// renewLock refreshes the lock of vdiname unless it was released meanwhile
+func (d SheepdogDriver) renewLock(vdiname string) {
+	d.Locks.mu.Lock()
+	defer d.Locks.mu.Unlock()
+	if d.Locks.held[vdiname] == false {
+		return
+	}
+	held, ok, err := d.readLock(vdiname)
+	if err != nil {
+		log.Error("Failed to renew the lock of ", vdiname, ": ", err)
+		return
+	}
+	if ok == true && held.Host != d.Conf.Hostname {
+		log.Errorf("Lost the lock of %s to %s, it must not be used on this host any more", vdiname, held.Host)
+		delete(d.Locks.held, vdiname)
+		return
+	}
+	if ok == false {
+		// removed by break-lock, another host may have taken it since:
+		// only take it back while it is free
+		if err := d.writeLock(vdiname, true); err != nil {
+			log.Errorf("Lost the lock of %s, it must not be used on this host any more: %v", vdiname, err)
+			delete(d.Locks.held, vdiname)
+			return
+		}
+		log.Warningf("Lock of %s was removed while attached, took it back", vdiname)
+		return
+	}
+	if err := d.writeLock(vdiname, false); err != nil {
+		log.Error("Failed to renew the lock of ", vdiname, ": ", err)
+	}
+}
+
+// startHeartbeat renews the locks held by this host in the background,
+// often enough that they never expire while the plugin is running
+func (d SheepdogDriver) startHeartbeat() {
+	interval := d.lockTimeout() / 4
+	log.Infof("Renewing volume locks every %s", interval)
+	go func() {
+		for range time.Tick(interval) {
+			d.renewLocks()
+		}
+	}()
+}
+
+// breakLock removes the lock of the volume name whoever holds it,
+// for volumes left locked by a host which is gone for good.
+// A host still running with the volume attached takes the lock back
+// at its next renewal if no other host took it first.
+func (d SheepdogDriver) breakLock(name string) (attachLock, error) {
+	vdiname := d.vdiName(name)
+	held, ok, err := d.readLock(vdiname)
+	if ok == false {
+		if err != nil {
+			return held, err
+		}
+		return held, errors.New("Volume is not locked: " + name)
+	}
+	if err := dogVdiDelattr(d.Runner, vdiname, lockAttr, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort); err != nil {
+		log.Error("Error dogVdiDelattr: ", err)
+		return held, errors.New("Failed to break the lock of " + name)
+	}
+	return held, nil
+}
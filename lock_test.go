@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testForeignLock = `{"Host":"host2","Time":"2017-10-03T00:00:00Z"}`
+
+// lockStore keeps the dvp.lock attributes the way sheep does, so that
+// setattr -x fails on a set attribute, and passes the other commands
+// to a fakeRunner
+type lockStore struct {
+	*fakeRunner
+	mu    sync.Mutex
+	locks map[string]string
+	// beforeGet is called with the number of the getattr about to be answered
+	beforeGet func(n int)
+	gets      int
+	// afterGet is called with mu held once a getattr is answered
+	afterGet func()
+}
+
+func newLockStore() *lockStore {
+	return &lockStore{fakeRunner: &fakeRunner{}, locks: make(map[string]string)}
+}
+
+func (s *lockStore) Run(name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	if strings.Contains(line, lockAttr) == false {
+		return s.fakeRunner.Run(name, args...)
+	}
+	s.fakeRunner.mu.Lock()
+	s.fakeRunner.calls = append(s.fakeRunner.calls, line)
+	s.fakeRunner.mu.Unlock()
+
+	fail := func(out string) ([]byte, error) {
+		return []byte(out), &CommandError{Command: commandLabel(name, args), Output: out, Err: errors.New("exit status 1")}
+	}
+	// sudo dog vdi getattr|setattr [-x|-d] vdiname dvp.lock [value]
+	op, rest := args[2], args[3:]
+	if op == "getattr" {
+		s.mu.Lock()
+		s.gets++
+		n, hook := s.gets, s.beforeGet
+		s.mu.Unlock()
+		if hook != nil {
+			hook(n)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case op == "getattr":
+		value, ok := s.locks[rest[0]]
+		if s.afterGet != nil {
+			s.afterGet()
+		}
+		if ok == false {
+			return fail("Attribute '" + lockAttr + "' not found")
+		}
+		return []byte(value), nil
+	case rest[0] == "-d":
+		delete(s.locks, rest[1])
+	case rest[0] == "-x":
+		if _, ok := s.locks[rest[1]]; ok {
+			return fail("Failed to set attribute: VDI attribute exists")
+		}
+		s.locks[rest[1]] = rest[3]
+	default:
+		s.locks[rest[0]] = rest[2]
+	}
+	return nil, nil
+}
+
+func (s *lockStore) lock(vdiname string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.locks[vdiname]
+}
+
+func (s *lockStore) set(vdiname, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locks[vdiname] = value
+}
+
+// newLockDriver returns a driver keeping its locks in a lockStore,
+// whose locks expire after 50ms
+func newLockDriver(t *testing.T) (SheepdogDriver, *lockStore, string) {
+	s := newLockStore()
+	d, dir := newTestDriver(t, s.fakeRunner)
+	d.Runner = s
+	d.Conf.LockTimeout = "50ms"
+	return d, s, dir
+}
+
+func TestLockVolume(t *testing.T) {
+	d, s, dir := newLockDriver(t)
+	defer os.RemoveAll(dir)
+
+	if err := d.lockVolume("dvp-vol1"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(s.lock("dvp-vol1"), `"Host":"host1"`) == false || d.Locks.held["dvp-vol1"] == false {
+		t.Errorf("lock %q, held %v", s.lock("dvp-vol1"), d.Locks.held)
+	}
+	// taken again by this host, e.g. after a crash
+	if err := d.lockVolume("dvp-vol1"); err != nil {
+		t.Error("lock held by this host: ", err)
+	}
+
+	d.unlockVolume("dvp-vol1")
+	if s.lock("dvp-vol1") != "" || d.Locks.held["dvp-vol1"] == true {
+		t.Errorf("unlocked: lock %q, held %v", s.lock("dvp-vol1"), d.Locks.held)
+	}
+	// the lock of another host is not released
+	s.set("dvp-vol1", testForeignLock)
+	d.unlockVolume("dvp-vol1")
+	if s.lock("dvp-vol1") != testForeignLock {
+		t.Errorf("released the lock of host2: %q", s.lock("dvp-vol1"))
+	}
+}
+
+func TestLockForeignExpired(t *testing.T) {
+	d, s, dir := newLockDriver(t)
+	defer os.RemoveAll(dir)
+	s.set("dvp-vol1", testForeignLock)
+
+	err := d.lockVolume("dvp-vol1")
+	if err == nil || strings.HasPrefix(err.Error(), "Volume is attached on host host2") == false {
+		t.Fatalf("foreign lock: %v", err)
+	}
+	// host2 renews its lock, which starts the timeout again
+	time.Sleep(60 * time.Millisecond)
+	renewed := `{"Host":"host2","Time":"2017-10-03T00:01:00Z"}`
+	s.set("dvp-vol1", renewed)
+	if err := d.lockVolume("dvp-vol1"); err == nil {
+		t.Fatal("took over a renewed lock")
+	}
+	if s.lock("dvp-vol1") != renewed {
+		t.Fatalf("renewed lock changed: %q", s.lock("dvp-vol1"))
+	}
+
+	// host2 stops renewing it
+	time.Sleep(60 * time.Millisecond)
+	if err := d.lockVolume("dvp-vol1"); err != nil {
+		t.Fatal("expired lock: ", err)
+	}
+	if strings.Contains(s.lock("dvp-vol1"), `"Host":"host1"`) == false || d.Locks.held["dvp-vol1"] == false {
+		t.Errorf("lock %q, held %v", s.lock("dvp-vol1"), d.Locks.held)
+	}
+}
+
+func TestLockTakeoverRace(t *testing.T) {
+	d, s, dir := newLockDriver(t)
+	defer os.RemoveAll(dir)
+	s.set("dvp-vol1", testForeignLock)
+
+	if err := d.lockVolume("dvp-vol1"); err == nil {
+		t.Fatal("took over a fresh lock")
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// host3 takes the expired lock over between our read and our swap
+	host3 := `{"Host":"host3","Time":"2017-10-03T00:02:00Z"}`
+	s.gets = 0
+	s.beforeGet = func(n int) {
+		if n == 2 {
+			s.set("dvp-vol1", host3)
+		}
+	}
+	err := d.lockVolume("dvp-vol1")
+	if err == nil || strings.Contains(err.Error(), "changed while taking it over") == false {
+		t.Errorf("takeover race: %v", err)
+	}
+	if s.lock("dvp-vol1") != host3 || d.Locks.held["dvp-vol1"] == true {
+		t.Errorf("lock %q, held %v", s.lock("dvp-vol1"), d.Locks.held)
+	}
+	if len(s.called("setattr -d")) != 0 {
+		t.Errorf("deleted the lock of host3: %q", s.calls)
+	}
+}
+
+func TestLockUnparsable(t *testing.T) {
+	d, s, dir := newLockDriver(t)
+	defer os.RemoveAll(dir)
+	s.set("dvp-vol1", "host2")
+
+	for i := 0; i < 2; i++ {
+		err := d.lockVolume("dvp-vol1")
+		if err == nil || strings.Contains(err.Error(), "can not be parsed") == false {
+			t.Errorf("unparsable lock: %v", err)
+		}
+		time.Sleep(60 * time.Millisecond)
+	}
+	if s.lock("dvp-vol1") != "host2" || len(s.called("setattr -d")) != 0 {
+		t.Errorf("unparsable lock taken over: %q", s.lock("dvp-vol1"))
+	}
+	d.unlockVolume("dvp-vol1")
+	if s.lock("dvp-vol1") != "host2" {
+		t.Errorf("unparsable lock released: %q", s.lock("dvp-vol1"))
+	}
+}
+
+func TestRenewLock(t *testing.T) {
+	d, s, dir := newLockDriver(t)
+	defer os.RemoveAll(dir)
+
+	if err := d.lockVolume("dvp-vol1"); err != nil {
+		t.Fatal(err)
+	}
+	old := `{"Host":"host1","Time":"2017-10-03T00:00:00Z"}`
+	s.set("dvp-vol1", old)
+	d.renewLocks()
+	if value := s.lock("dvp-vol1"); value == old || strings.Contains(value, `"Host":"host1"`) == false {
+		t.Errorf("renewed lock: %q", value)
+	}
+
+	// taken over by host2 meanwhile: not written back
+	s.set("dvp-vol1", testForeignLock)
+	d.renewLocks()
+	if s.lock("dvp-vol1") != testForeignLock || d.Locks.held["dvp-vol1"] == true {
+		t.Errorf("lost lock: %q, held %v", s.lock("dvp-vol1"), d.Locks.held)
+	}
+
+	// removed by break-lock: taken back while free
+	d.Locks.held["dvp-vol1"] = true
+	delete(s.locks, "dvp-vol1")
+	d.renewLocks()
+	if strings.Contains(s.lock("dvp-vol1"), `"Host":"host1"`) == false || d.Locks.held["dvp-vol1"] == false {
+		t.Errorf("removed lock: %q, held %v", s.lock("dvp-vol1"), d.Locks.held)
+	}
+
+	// removed, then taken by host2 between the read and the write
+	delete(s.locks, "dvp-vol1")
+	s.afterGet = func() { s.locks["dvp-vol1"] = testForeignLock }
+	d.renewLocks()
+	if s.lock("dvp-vol1") != testForeignLock || d.Locks.held["dvp-vol1"] == true {
+		t.Errorf("lock taken by host2: %q, held %v", s.lock("dvp-vol1"), d.Locks.held)
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	"math/rand"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -38,6 +38,7 @@ var (
 )
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	if *version {
 		fmt.Println("Docker Volume Plugin for Sheepdog")
@@ -51,34 +52,26 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	log.Info("Starting sheepdog-docker-driver version: ", Version)
 
-	// check cmd support
-	if iscmdSupported("sudo") == false {
-		err := errors.New("sudo command not found on this host")
-		log.Error(err)
-		os.Exit(1)
-	}
-	if iscmdSupported("iscsiadm") == false {
-		err := errors.New("iscsi-initiator-utils(iscsiadm command) not found on this host")
-		log.Error(err)
-		os.Exit(1)
-	}
-	if iscmdSupported("tgtadm") == false {
-		err := errors.New("scsi-target-utils(tgtadm command) not found on this host")
-		log.Error(err)
-		os.Exit(1)
-	}
-	if iscmdSupported("dog") == false {
-		err := errors.New("sheepdog(dog command) not found on this host")
-		log.Error(err)
-		os.Exit(1)
-	}
+	// jitter of the retries
+	rand.Seed(time.Now().UnixNano())
 
 	u, _ := user.Lookup("root")
 	gid, _ := strconv.Atoi(u.Gid)
 
-	d := newSheepdogDriver(*cfgFile)
-	h := volume.NewHandler(d)
+	m := newMetrics()
+	d := newSheepdogDriver(*cfgFile, instrumentedRunner{Runner: &execRunner{}, metrics: m})
+	if d.Conf.MetricsAddr != "" {
+		go d.serveMetrics(m)
+	}
+	if d.Conf.AdminSocket != "" {
+		go d.serveAdmin()
+	}
+	h := volume.NewHandler(instrumentedDriver{SheepdogDriver: d, metrics: m})
 	log.Info(h.ServeUnix("sheepdog", gid))
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// latency buckets in seconds, from a quick dog call to a mkfs of a big volume
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// histogram is a Prometheus histogram with metricsBuckets
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricsBuckets))
+	}
+	for i, le := range metricsBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write prints the histogram in the Prometheus text format,
+// label is the label pair of the series, e.g. api="Mount"
+func (h *histogram) write(w io.Writer, name, label string) {
+	for i, le := range metricsBuckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, label, le, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, label, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, label, h.count)
+}
+
+// metrics collects what the plugin exports on MetricsAddr
+type metrics struct {
+	mu           sync.Mutex
+	requests     map[string]uint64 // api + " " + result
+	requestTimes map[string]*histogram
+	commandTimes map[string]*histogram
+	commandFails map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:     make(map[string]uint64),
+		requestTimes: make(map[string]*histogram),
+		commandTimes: make(map[string]*histogram),
+		commandFails: make(map[string]uint64),
+	}
+}
+
+// observeRequest records a call of the volume API
+func (m *metrics) observeRequest(api string, start time.Time, resp volume.Response) {
+	result := "ok"
+	if resp.Err != "" {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[api+" "+result]++
+	h, ok := m.requestTimes[api]
+	if !ok {
+		h = &histogram{}
+		m.requestTimes[api] = h
+	}
+	h.observe(time.Since(start).Seconds())
+}
+
+// observeCommand records a run of an external command
+func (m *metrics) observeCommand(command string, start time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.commandTimes[command]
+	if !ok {
+		h = &histogram{}
+		m.commandTimes[command] = h
+	}
+	h.observe(time.Since(start).Seconds())
+	if err != nil {
+		m.commandFails[command]++
+	}
+}
+
+// commandLabel names a command line for the metrics without its arguments,
+// e.g. "dog vdi create" or "tgtadm"
+func commandLabel(name string, args []string) string {
+	if name == "sudo" {
+		// sudo -n tgtadm ...
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			name, args = args[0], args[1:]
+		}
+	}
+	name = filepath.Base(name)
+	if name == "dog" && len(args) >= 2 {
+		return name + " " + args[0] + " " + args[1]
+	}
+	return name
+}
+
+// instrumentedRunner times the commands of another Runner
+type instrumentedRunner struct {
+	Runner  Runner
+	metrics *metrics
+}
+
+// Run runs the command with the wrapped Runner and records it
+func (r instrumentedRunner) Run(name string, args ...string) ([]byte, error) {
+	start := time.Now()
+	out, err := r.Runner.Run(name, args...)
+	r.metrics.observeCommand(commandLabel(name, args), start, err)
+	return out, err
+}
+
+// SetTimeouts passes the command timeouts to the wrapped Runner
+func (r instrumentedRunner) SetTimeouts(timeouts map[string]time.Duration) {
+	if t, ok := r.Runner.(timeoutRunner); ok {
+		t.SetTimeouts(timeouts)
+	}
+}
+
+// instrumentedDriver records the calls of the volume API
+type instrumentedDriver struct {
+	SheepdogDriver
+	metrics *metrics
+}
+
+// Create API
+func (d instrumentedDriver) Create(r volume.Request) volume.Response {
+	start := time.Now()
+	resp := d.SheepdogDriver.Create(r)
+	d.metrics.observeRequest("Create", start, resp)
+	return resp
+}
+
+// Remove API
+func (d instrumentedDriver) Remove(r volume.Request) volume.Response {
+	start := time.Now()
+	resp := d.SheepdogDriver.Remove(r)
+	d.metrics.observeRequest("Remove", start, resp)
+	return resp
+}
+
+// Mount API
+func (d instrumentedDriver) Mount(r volume.MountRequest) volume.Response {
+	start := time.Now()
+	resp := d.SheepdogDriver.Mount(r)
+	d.metrics.observeRequest("Mount", start, resp)
+	return resp
+}
+
+// Unmount API
+func (d instrumentedDriver) Unmount(r volume.UnmountRequest) volume.Response {
+	start := time.Now()
+	resp := d.SheepdogDriver.Unmount(r)
+	d.metrics.observeRequest("Unmount", start, resp)
+	return resp
+}
+
+// Get API
+func (d instrumentedDriver) Get(r volume.Request) volume.Response {
+	start := time.Now()
+	resp := d.SheepdogDriver.Get(r)
+	d.metrics.observeRequest("Get", start, resp)
+	return resp
+}
+
+// List API
+func (d instrumentedDriver) List(r volume.Request) volume.Response {
+	start := time.Now()
+	resp := d.SheepdogDriver.List(r)
+	d.metrics.observeRequest("List", start, resp)
+	return resp
+}
+
+// sortedKeys returns the keys of a metrics map in a stable order
+func sortedKeys(m map[string]*histogram) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quoteLabel escapes a label value of the text format
+func quoteLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+// writeMetrics prints all the metrics in the Prometheus text format
+func (d SheepdogDriver) writeMetrics(w io.Writer, m *metrics) {
+	m.mu.Lock()
+	fmt.Fprintln(w, "# HELP sheepdog_plugin_requests_total Volume API requests by result.")
+	fmt.Fprintln(w, "# TYPE sheepdog_plugin_requests_total counter")
+	var reqs []string
+	for k := range m.requests {
+		reqs = append(reqs, k)
+	}
+	sort.Strings(reqs)
+	for _, k := range reqs {
+		f := strings.SplitN(k, " ", 2)
+		fmt.Fprintf(w, "sheepdog_plugin_requests_total{api=\"%s\",result=\"%s\"} %d\n", f[0], f[1], m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP sheepdog_plugin_request_duration_seconds Time spent in the volume API.")
+	fmt.Fprintln(w, "# TYPE sheepdog_plugin_request_duration_seconds histogram")
+	for _, k := range sortedKeys(m.requestTimes) {
+		m.requestTimes[k].write(w, "sheepdog_plugin_request_duration_seconds", "api=\""+k+"\"")
+	}
+
+	fmt.Fprintln(w, "# HELP sheepdog_plugin_command_duration_seconds Time spent in external commands.")
+	fmt.Fprintln(w, "# TYPE sheepdog_plugin_command_duration_seconds histogram")
+	for _, k := range sortedKeys(m.commandTimes) {
+		m.commandTimes[k].write(w, "sheepdog_plugin_command_duration_seconds", "command=\""+quoteLabel(k)+"\"")
+	}
+
+	fmt.Fprintln(w, "# HELP sheepdog_plugin_command_failures_total External commands which failed.")
+	fmt.Fprintln(w, "# TYPE sheepdog_plugin_command_failures_total counter")
+	for _, k := range sortedKeys(m.commandTimes) {
+		fmt.Fprintf(w, "sheepdog_plugin_command_failures_total{command=\"%s\"} %d\n", quoteLabel(k), m.commandFails[k])
+	}
+	m.mu.Unlock()
+
+	volumes := d.State.snapshot()
+	var names []string
+	for name, vs := range volumes {
+		if len(vs.IDs) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP sheepdog_plugin_attached_luns LUNs attached on this host.")
+	fmt.Fprintln(w, "# TYPE sheepdog_plugin_attached_luns gauge")
+	fmt.Fprintf(w, "sheepdog_plugin_attached_luns %d\n", len(names))
+	fmt.Fprintln(w, "# HELP sheepdog_plugin_volume_refcount Containers using each attached volume.")
+	fmt.Fprintln(w, "# TYPE sheepdog_plugin_volume_refcount gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "sheepdog_plugin_volume_refcount{volume=\"%s\"} %d\n", quoteLabel(name), len(volumes[name].IDs))
+	}
+}
+
+// serveMetrics exports the metrics on MetricsAddr at /metrics
+func (d SheepdogDriver) serveMetrics(m *metrics) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.writeMetrics(w, m)
+	})
+	log.Infof("Serving metrics on %s", d.Conf.MetricsAddr)
+	if err := http.ListenAndServe(d.Conf.MetricsAddr, mux); err != nil {
+		log.Error("Failed to serve metrics: ", err)
+	}
+}
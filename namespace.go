@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+)
+
+// namespacedVdiNameTemplate is the default VdiNameTemplate when a Namespace is set
+const namespacedVdiNameTemplate = "{{.Prefix}}-{{.Namespace}}-{{.Name}}"
+
+// checkNamespace refuses volumes of another namespace than the one of
+// this plugin. The namespace recorded in the volume options decides,
+// since a vdi name alone can look like it belongs to several namespaces.
+// It takes the result of readVolumeOptions, a read error is returned as is.
+func (d SheepdogDriver) checkNamespace(opts volumeOptions, err error) error {
+	if err != nil {
+		return errors.New("Failed to read the volume options: " + err.Error())
+	}
+	if opts.Namespace != d.Conf.Namespace {
+		return errors.New("Volume belongs to another namespace")
+	}
+	return nil
+}
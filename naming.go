@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultVdiNameTemplate keeps the <VdiSuffix>-<volume> vdi names
+const defaultVdiNameTemplate = "{{.Prefix}}-{{.Name}}"
+
+// vdiNameFields are what VdiNameTemplate can use
+type vdiNameFields struct {
+	// VdiSuffix of the config
+	Prefix string
+	// Hostname of the config
+	Host string
+	// Namespace of the config
+	Namespace string
+	// Docker volume name
+	Name string
+	// sha256 of the Docker volume name, in hex
+	Hash string
+}
+
+// markers standing for the fields when the template is turned into a regexp
+const (
+	markPrefix = "\x00prefix\x00"
+	markHost   = "\x00host\x00"
+	markNs     = "\x00namespace\x00"
+	markName   = "\x00name\x00"
+	markHash   = "\x00hash\x00"
+)
+
+// vdiNamer maps Docker volume names to vdi names with VdiNameTemplate
+// and back. Vdi names which are too long are replaced by <Prefix>-<sha256
+// of the vdi name>, so they keep the Host and Namespace of the template.
+// The Docker name of those is kept in the volume options.
+type vdiNamer struct {
+	tmpl    *template.Template
+	prefix  string
+	host    string
+	ns      string
+	re      *regexp.Regexp
+	hasName bool
+	hashed  *regexp.Regexp
+}
+
+// newVdiNamer parses the template and builds its reverse regexp
+func newVdiNamer(text, prefix, host, ns string) (*vdiNamer, error) {
+	tmpl, err := template.New("vdiname").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	n := &vdiNamer{
+		tmpl:   tmpl,
+		prefix: prefix,
+		host:   host,
+		ns:     ns,
+		hashed: regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "-[0-9a-f]{64}$"),
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, vdiNameFields{Prefix: markPrefix, Host: markHost, Namespace: markNs, Name: markName, Hash: markHash})
+	if err != nil {
+		return nil, err
+	}
+	pattern := regexp.QuoteMeta(buf.String())
+	pattern = strings.Replace(pattern, markPrefix, regexp.QuoteMeta(prefix), -1)
+	pattern = strings.Replace(pattern, markHost, regexp.QuoteMeta(host), -1)
+	pattern = strings.Replace(pattern, markNs, regexp.QuoteMeta(ns), -1)
+	pattern = strings.Replace(pattern, markHash, "[0-9a-f]{64}", -1)
+	if strings.Contains(pattern, markName) {
+		n.hasName = true
+		pattern = strings.Replace(pattern, markName, "(.+)", 1)
+		pattern = strings.Replace(pattern, markName, ".+", -1)
+	}
+	if n.re, err = regexp.Compile("^" + pattern + "$"); err != nil {
+		return nil, err
+	}
+
+	// every volume needs a vdi of its own
+	a, err := n.render("a")
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.render("b")
+	if err != nil {
+		return nil, err
+	}
+	if a == b {
+		return nil, errors.New("VdiNameTemplate must use .Name or .Hash")
+	}
+	return n, nil
+}
+
+// render executes the template for the Docker volume name
+func (n *vdiNamer) render(name string) (string, error) {
+	var buf bytes.Buffer
+	sum := sha256.Sum256([]byte(name))
+	err := n.tmpl.Execute(&buf, vdiNameFields{
+		Prefix:    n.prefix,
+		Host:      n.host,
+		Namespace: n.ns,
+		Name:      name,
+		Hash:      hex.EncodeToString(sum[:]),
+	})
+	return buf.String(), err
+}
+
+// vdiName returns the vdi backing the Docker volume name
+func (n *vdiNamer) vdiName(name string) string {
+	vdiname, err := n.render(name)
+	if err != nil {
+		log.Error("Failed to render VdiNameTemplate: ", err)
+	}
+	if err != nil || vdiname == "" {
+		// nothing to hash but the name, keep the host and namespace apart
+		vdiname = n.host + "/" + n.ns + "/" + name
+	} else if len(vdiname) < sdMaxVdiLen {
+		return vdiname
+	}
+	sum := sha256.Sum256([]byte(vdiname))
+	return n.prefix + "-" + hex.EncodeToString(sum[:])
+}
+
+// parse returns the Docker volume name encoded in vdiname by the template.
+// known is false when vdiname does not match the template, and name is
+// empty when the template does not keep the name.
+func (n *vdiNamer) parse(vdiname string) (name string, known bool) {
+	m := n.re.FindStringSubmatch(vdiname)
+	if m == nil {
+		return "", false
+	}
+	if n.hasName == false {
+		return "", true
+	}
+	if n.vdiName(m[1]) != vdiname {
+		return "", false
+	}
+	return m[1], true
+}
+
+// vdiName returns the vdi backing the Docker volume name
+func (d SheepdogDriver) vdiName(name string) string {
+	return d.Namer.vdiName(name)
+}
+
+// volumeName returns the Docker volume name of a vdi,
+// or an empty string when the vdi is not one of our volumes.
+// Hashed names are looked up in the volume options.
+func (d SheepdogDriver) volumeName(vdiname string) string {
+	return d.resolveVolumeName(vdiname, func() (volumeOptions, error) {
+		return d.readVolumeOptions(vdiname)
+	})
+}
+
+// resolveVolumeName is volumeName with the options of vdiname read by load,
+// which is only called when the name is not in vdiname itself.
+// A vdi whose options can not be read is skipped rather than shown
+// under its vdi name.
+func (d SheepdogDriver) resolveVolumeName(vdiname string, load func() (volumeOptions, error)) string {
+	if d.Namer.hashed.MatchString(vdiname) {
+		name, err := d.storedVolumeName(vdiname, load)
+		if err != nil {
+			log.Warningf("Skipping %s, its options can not be read: %v", vdiname, err)
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	name, known := d.Namer.parse(vdiname)
+	if name == "" && known == true {
+		name, err := d.storedVolumeName(vdiname, load)
+		if err != nil {
+			log.Warningf("Skipping %s, its options can not be read: %v", vdiname, err)
+		}
+		return name
+	}
+	return name
+}
+
+// storedVolumeName returns the Docker name kept in the options of vdiname
+// if it still maps to vdiname
+func (d SheepdogDriver) storedVolumeName(vdiname string, load func() (volumeOptions, error)) (string, error) {
+	opts, err := load()
+	if err != nil {
+		return "", err
+	}
+	if opts.Name != "" && d.vdiName(opts.Name) == vdiname {
+		return opts.Name, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVdiNamer(t *testing.T) {
+	sum := sha256.Sum256([]byte("vol1"))
+	hash := hex.EncodeToString(sum[:])
+
+	cases := []struct {
+		tmpl    string
+		ns      string
+		vdiname string
+		// Docker name parsed back, empty when the template does not keep it
+		parsed string
+	}{
+		{defaultVdiNameTemplate, "", "dvp-vol1", "vol1"},
+		{namespacedVdiNameTemplate, "team", "dvp-team-vol1", "vol1"},
+		{"{{.Prefix}}-{{.Host}}-{{.Name}}", "", "dvp-host1-vol1", "vol1"},
+		{"{{.Prefix}}-{{.Hash}}", "", "dvp-" + hash, ""},
+		{"{{.Prefix}}.{{.Name}}", "", "dvp.vol1", "vol1"},
+	}
+	for _, c := range cases {
+		n, err := newVdiNamer(c.tmpl, "dvp", "host1", c.ns)
+		if err != nil {
+			t.Errorf("%s: %v", c.tmpl, err)
+			continue
+		}
+		if got := n.vdiName("vol1"); got != c.vdiname {
+			t.Errorf("%s: vdi name %q, want %q", c.tmpl, got, c.vdiname)
+		}
+		if name, known := n.parse(c.vdiname); known == false || name != c.parsed {
+			t.Errorf("%s: parsed %q %v, want %q", c.tmpl, name, known, c.parsed)
+		}
+		// the vdis of other templates, hosts and users are not ours
+		for _, other := range []string{"vol1", "dvpx-vol1", "dvp-host2-vol1", "dvp-other-vol1", "dvp-" + hash[1:]} {
+			if other == c.vdiname {
+				continue
+			}
+			if name, known := n.parse(other); known == true && name != "" && n.vdiName(name) != other {
+				t.Errorf("%s: parsed %q as %q", c.tmpl, other, name)
+			}
+		}
+	}
+}
+
+func TestVdiNamerLongName(t *testing.T) {
+	n, err := newVdiNamer(defaultVdiNameTemplate, "dvp", "host1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", sdMaxVdiLen)
+	vdiname := n.vdiName(long)
+	sum := sha256.Sum256([]byte("dvp-" + long))
+	if vdiname != "dvp-"+hex.EncodeToString(sum[:]) {
+		t.Errorf("long name: vdi name %q", vdiname)
+	}
+	if n.hashed.MatchString(vdiname) == false || n.hashed.MatchString("dvp-vol1") == true {
+		t.Error("hashed names are not told apart")
+	}
+	// the vdi of a long name is also the one of a volume named by its hash
+	if name, _ := n.parse(vdiname); name != hex.EncodeToString(sum[:]) {
+		t.Errorf("long name parsed as %q", name)
+	}
+
+	// hosts naming vdis apart keep their long names apart too
+	h1, err := newVdiNamer("{{.Prefix}}-{{.Host}}-{{.Name}}", "dvp", "host1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := newVdiNamer("{{.Prefix}}-{{.Host}}-{{.Name}}", "dvp", "host2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1.vdiName(long) == h2.vdiName(long) {
+		t.Errorf("long name: same vdi %q on both hosts", h1.vdiName(long))
+	}
+	// and so do namespaces
+	ns1, err := newVdiNamer(namespacedVdiNameTemplate, "dvp", "host1", "ns1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns2, err := newVdiNamer(namespacedVdiNameTemplate, "dvp", "host1", "ns2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns1.vdiName(long) == ns2.vdiName(long) || ns1.vdiName(long) == n.vdiName(long) {
+		t.Errorf("long name: same vdi %q in both namespaces", ns1.vdiName(long))
+	}
+	if h1.hashed.MatchString(h1.vdiName(long)) == false {
+		t.Errorf("long name: vdi %q not hashed", h1.vdiName(long))
+	}
+}
+
+func TestVdiNamerInvalid(t *testing.T) {
+	for _, tmpl := range []string{
+		"{{.Prefix}}-{{.Host}}",
+		"{{.Prefix}}-{{.Missing}}",
+		"{{.Prefix}-{{.Name}}",
+	} {
+		if _, err := newVdiNamer(tmpl, "dvp", "host1", ""); err == nil {
+			t.Errorf("%s: accepted", tmpl)
+		}
+	}
+}
+
+func TestVolumeNameHashed(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+
+	long := strings.Repeat("a", sdMaxVdiLen)
+	vdiname := d.vdiName(long)
+	f.on("getattr "+vdiname+" dvp.options", `{"Name":"`+long+`"}`)
+	if got := d.volumeName(vdiname); got != long {
+		t.Errorf("hashed vdi: volume name %q", got)
+	}
+	// options not mapping to the vdi leave the name in the vdi name
+	f.on("getattr "+vdiname+" dvp.options", `{"Name":"other"}`)
+	if got := d.volumeName(vdiname); got != strings.TrimPrefix(vdiname, "dvp-") {
+		t.Errorf("hashed vdi of another name: volume name %q", got)
+	}
+	f.fail("getattr "+vdiname+" dvp.options", "failed to connect to 127.0.0.1:7000")
+	if got := d.volumeName(vdiname); got != "" {
+		t.Errorf("unreadable options: volume name %q", got)
+	}
+	if got := d.volumeName("dvp-vol1"); got != "vol1" {
+		t.Errorf("plain vdi: volume name %q", got)
+	}
+}
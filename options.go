@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// vdi attribute holding the volumeOptions of a volume
+const optionsAttr = "dvp.options"
+
+// supportedFsTypes are the filesystems Mount knows how to format
+var supportedFsTypes = map[string]bool{
+	"xfs":   true,
+	"ext4":  true,
+	"btrfs": true,
+}
+
+// defaultAllowedMountOpts is used when AllowedMountOpts is not configured.
+// An entry ending with "=" allows any value for that option.
+var defaultAllowedMountOpts = []string{
+	"noatime", "nodiratime", "relatime", "lazytime",
+	"discard", "nobarrier", "nosuid", "nodev", "noexec", "sync",
+	"inode64", "largeio", "logbufs=", "logbsize=", "allocsize=",
+	"commit=", "data=", "compress=", "ssd",
+}
+
+// labelPrefix marks Create options which are only stored as labels
+const labelPrefix = "label."
+
+// volumeOptions are the options a volume was created with.
+// They are stored with the vdi, so every host in the cluster knows how
+// the volume was made and formats and mounts it the same way.
+type volumeOptions struct {
+	Name      string            `json:",omitempty"`
+	Namespace string            `json:",omitempty"`
+	Size      string            `json:",omitempty"`
+	Copies    string            `json:",omitempty"`
+	Prealloc  bool              `json:",omitempty"`
+	Hyper     bool              `json:",omitempty"`
+	Bsize     string            `json:",omitempty"`
+	FsType    string            `json:",omitempty"`
+	MkfsOpts  string            `json:",omitempty"`
+	MountOpts string            `json:",omitempty"`
+	ReadOnly  bool              `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+}
+
+// mountOptions returns the -o argument of mount for the volume
+func (o volumeOptions) mountOptions() string {
+	opts := o.MountOpts
+	if o.ReadOnly == true {
+		if opts != "" {
+			opts += ","
+		}
+		opts += "ro"
+	}
+	return opts
+}
+
+// checkMountOpts makes sure every comma separated option in opts
+// is listed in AllowedMountOpts
+func (d SheepdogDriver) checkMountOpts(opts string) error {
+	if opts == "" {
+		return nil
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		allowed := false
+		for _, a := range d.Conf.AllowedMountOpts {
+			if opt == a || (strings.HasSuffix(a, "=") && strings.HasPrefix(opt, a)) {
+				allowed = true
+				break
+			}
+		}
+		if allowed == false {
+			return errors.New("Mount option is not allowed: " + opt)
+		}
+	}
+	return nil
+}
+
+// mkfsFlags are the options allowed in mkfsopts by filesystem, true for
+// the ones taking a value. The options reading or writing other files,
+// such as mkfs.ext4 -d or mkfs.xfs -p, are left out.
+var mkfsFlags = map[string]map[string]bool{
+	"xfs": {
+		"-b": true, "-d": true, "-i": true, "-l": true, "-m": true, "-n": true, "-s": true, "-L": true,
+		"-K": false, "-q": false,
+	},
+	"ext4": {
+		"-b": true, "-i": true, "-I": true, "-m": true, "-N": true, "-O": true, "-E": true, "-L": true, "-T": true,
+		"-j": false, "-q": false,
+	},
+	"btrfs": {
+		"-L": true, "-m": true, "-d": true, "-n": true, "-s": true, "-O": true,
+		"-M": false, "-K": false, "-q": false,
+	},
+}
+
+// checkMkfsOpts makes sure mkfsOpts only has the options of mkfsFlags
+// for fsType, each value given as a separate word and not a path
+func checkMkfsOpts(fsType, mkfsOpts string) error {
+	flags := mkfsFlags[fsType]
+	args := strings.Fields(mkfsOpts)
+	for i := 0; i < len(args); i++ {
+		takesValue, ok := flags[args[i]]
+		if ok == false {
+			return errors.New("Mkfs option is not allowed for " + fsType + ": " + args[i])
+		}
+		if takesValue == false {
+			continue
+		}
+		if i+1 == len(args) || strings.HasPrefix(args[i+1], "-") || strings.Contains(args[i+1], "/") {
+			return errors.New("Mkfs option " + args[i] + " needs a value which is not a path")
+		}
+		i++
+	}
+	return nil
+}
+
+// saveVolumeOptions stores opts as a vdi attribute
+func (d SheepdogDriver) saveVolumeOptions(vdiname string, opts volumeOptions) error {
+	content, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	return dogVdiSetattr(d.Runner, vdiname, optionsAttr, string(content), d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+}
+
+// readVolumeOptions reads the options stored with a vdi.
+// Volumes created before options were stored have none,
+// err is only set when the options could not be read.
+func (d SheepdogDriver) readVolumeOptions(vdiname string) (volumeOptions, error) {
+	var opts volumeOptions
+	content, err := dogVdiGetattr(d.Runner, vdiname, optionsAttr, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err == errAttrNotFound || (err == nil && content == "") {
+		return opts, nil
+	}
+	if err != nil {
+		return opts, err
+	}
+	if err := json.Unmarshal([]byte(content), &opts); err != nil {
+		log.Warningf("Ignoring broken options of %s: %v", vdiname, err)
+	}
+	return opts, nil
+}
+
+// loadVolumeOptions reads the options stored with a vdi,
+// a failure is logged and gives no options
+func (d SheepdogDriver) loadVolumeOptions(vdiname string) volumeOptions {
+	opts, err := d.readVolumeOptions(vdiname)
+	if err != nil {
+		log.Warningf("Failed to read the options of %s: %v", vdiname, err)
+	}
+	return opts
+}
+
+// optionsCache keeps the options of the vdis seen by the listings, so
+// that listing the volumes does not read an attribute per vdi each time.
+// The options are written once when a vdi is created, an entry is keyed
+// by the vdi name and its creation time so a vdi created again under
+// the same name is read anew.
+type optionsCache struct {
+	mu      sync.Mutex
+	entries map[string]volumeOptions
+}
+
+func newOptionsCache() *optionsCache {
+	return &optionsCache{entries: make(map[string]volumeOptions)}
+}
+
+// optionsKey identifies a vdi in the cache
+func optionsKey(info VdiInfo) string {
+	return info.Name + "@" + strconv.FormatInt(info.CreateTime.UnixNano(), 10)
+}
+
+// retain drops the entries of the vdis which are gone
+func (c *optionsCache) retain(keys map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if keys[key] == false {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// listedVolumeOptions returns the options of a vdi found by a listing
+func (d SheepdogDriver) listedVolumeOptions(info VdiInfo) (volumeOptions, error) {
+	if d.OptionsCache == nil {
+		return d.readVolumeOptions(info.Name)
+	}
+	key := optionsKey(info)
+	d.OptionsCache.mu.Lock()
+	opts, ok := d.OptionsCache.entries[key]
+	d.OptionsCache.mu.Unlock()
+	if ok == true {
+		return opts, nil
+	}
+
+	opts, err := d.readVolumeOptions(info.Name)
+	// a vdi being created has no options yet, only cache stored ones
+	if err == nil && opts.Name != "" {
+		d.OptionsCache.mu.Lock()
+		d.OptionsCache.entries[key] = opts
+		d.OptionsCache.mu.Unlock()
+	}
+	return opts, err
+}
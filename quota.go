@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// checkQuota checks that vdiname may be given size bytes, as a new volume
+// or by resizing an existing one, without going over the quotas of the
+// config. The quotas cover the volumes this plugin lists, that is the
+// volumes of its namespace, and of its host when VdiNameTemplate uses .Host.
+// The caller must hold the driver mutex.
+func (d SheepdogDriver) checkQuota(vdiname string, size uint64) error {
+	if d.Conf.MaxVolumeSize != "" {
+		max, _ := parseSize(d.Conf.MaxVolumeSize)
+		if size > max {
+			return fmt.Errorf("Quota exceeded: volume size %s is over MaxVolumeSize %s", humanSize(size), d.Conf.MaxVolumeSize)
+		}
+	}
+	if d.Conf.MaxProvisionedSize == "" && d.Conf.MaxVolumes == 0 {
+		return nil
+	}
+
+	var (
+		provisioned uint64
+		count       int
+		exists      bool
+	)
+	// fail closed: a volume which can not be counted may be over the quota
+	vdis, err := d.ownVdis()
+	if err != nil {
+		return errors.New("Failed to check the quota: " + err.Error())
+	}
+	for _, o := range vdis {
+		if o.OptionsErr != nil {
+			return errors.New("Failed to check the quota: options of " + o.Name + " can not be read")
+		}
+		if o.Snapshot == true || d.checkNamespace(o.Options, nil) != nil {
+			continue
+		}
+		if o.Name == vdiname {
+			exists = true
+			continue
+		}
+		provisioned += o.Size
+		count++
+	}
+	log.Debugf("Quota: %d volume(s), %d bytes provisioned", count, provisioned)
+
+	if d.Conf.MaxVolumes != 0 && exists == false && count+1 > d.Conf.MaxVolumes {
+		return fmt.Errorf("Quota exceeded: %d volume(s) already exist, MaxVolumes is %d", count, d.Conf.MaxVolumes)
+	}
+	if d.Conf.MaxProvisionedSize != "" {
+		max, _ := parseSize(d.Conf.MaxProvisionedSize)
+		if provisioned+size > max {
+			return fmt.Errorf("Quota exceeded: %s provisioned, %s more is over MaxProvisionedSize %s", humanSize(provisioned), humanSize(size), d.Conf.MaxProvisionedSize)
+		}
+	}
+	return nil
+}
+
+// humanSize formats bytes with the units of dog, e.g. 10G or 1.5T
+func humanSize(size uint64) string {
+	units := "KMGTPE"
+	for i := len(units) - 1; i >= 0; i-- {
+		unit := uint64(1) << uint(10*(i+1))
+		if size >= unit {
+			n := strconv.FormatFloat(float64(size)/float64(unit), 'f', 1, 64)
+			return strings.TrimSuffix(n, ".0") + string(units[i])
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// testQuotaListing has vol1 of 1G with a snapshot and vol2 of 2G
+const testQuotaListing = "= dvp-vol1 0 1073741824 4194304 0 1507000000 7c2b25 3  22\n" +
+	"s dvp-vol1 1 1073741824 0 4194304 1506000000 7c2b24 3 snap1 22\n" +
+	"= dvp-vol2 0 2147483648 4194304 0 1507000000 7c2b26 3  22\n"
+
+func TestCheckQuota(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	f.on("vdi list -r", testQuotaListing)
+
+	cases := []struct {
+		name        string
+		maxSize     string
+		provisioned string
+		volumes     int
+		vdiname     string
+		size        uint64
+		err         string
+	}{
+		{"no quota", "", "", 0, "dvp-vol3", 1 << 40, ""},
+		{"size under", "1G", "", 0, "dvp-vol3", 1 << 30, ""},
+		{"size over", "1G", "", 0, "dvp-vol3", 1<<30 + 1, "over MaxVolumeSize"},
+		{"provisioned under", "", "4G", 0, "dvp-vol3", 1 << 30, ""},
+		{"provisioned over", "", "4G", 0, "dvp-vol3", 1<<30 + 1, "over MaxProvisionedSize"},
+		// a resize counts the new size instead of the old one
+		{"resize under", "", "4G", 0, "dvp-vol2", 3 << 30, ""},
+		{"resize over", "", "4G", 0, "dvp-vol2", 3<<30 + 1, "over MaxProvisionedSize"},
+		// the snapshot of vol1 is not a volume
+		{"count under", "", "", 3, "dvp-vol3", 1 << 30, ""},
+		{"count over", "", "", 2, "dvp-vol3", 1 << 30, "MaxVolumes is 2"},
+		{"count resize", "", "", 2, "dvp-vol2", 1 << 30, ""},
+	}
+	for _, c := range cases {
+		d.Conf.MaxVolumeSize = c.maxSize
+		d.Conf.MaxProvisionedSize = c.provisioned
+		d.Conf.MaxVolumes = c.volumes
+		err := d.checkQuota(c.vdiname, c.size)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || strings.Contains(err.Error(), c.err) == false) {
+			t.Errorf("%s: %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	cases := map[uint64]string{
+		512:                "512",
+		1 << 10:            "1K",
+		10 << 30:           "10G",
+		3 << 39:            "1.5T",
+		1<<30 + 1<<30/10*3: "1.3G",
+	}
+	for size, want := range cases {
+		if got := humanSize(size); got != want {
+			t.Errorf("%d: got %s, want %s", size, got, want)
+		}
+	}
+}
+
+func TestCheckQuotaUnreadable(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	d.Conf.MaxVolumes = 10
+
+	// the volumes can not be counted: refused
+	f.fail("vdi list -r", "Failed to connect to 127.0.0.1:7000")
+	if err := d.checkQuota("dvp-vol3", 1<<30); err == nil {
+		t.Error("quota checked without the listing")
+	}
+	f.on("vdi list -r", testQuotaListing)
+	f.fail("getattr dvp-vol2 dvp.options", "Failed to connect to 127.0.0.1:7000")
+	if err := d.checkQuota("dvp-vol3", 1<<30); err == nil || strings.Contains(err.Error(), "dvp-vol2") == false {
+		t.Errorf("quota checked without the options of vol2: %v", err)
+	}
+
+	// the size quota alone needs no listing
+	d.Conf.MaxVolumes = 0
+	d.Conf.MaxVolumeSize = "1G"
+	if err := d.checkQuota("dvp-vol3", 1<<30); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// mountInfoPath is the mount table read by readMountInfo
+var mountInfoPath = "/proc/self/mountinfo"
+
+// readMountInfo returns the source device of every mountpoint
+// listed in /proc/self/mountinfo
+func readMountInfo() (map[string]string, error) {
+	fp, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	mounts := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+3 {
+			continue
+		}
+		mounts[unescapeMountInfo(fields[4])] = unescapeMountInfo(fields[sep+2])
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes (\040 ...) of mountinfo
+func unescapeMountInfo(s string) string {
+	if strings.Index(s, "\\") < 0 {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// reconcile brings the driver state in line with the LUNs, devices and
+// mounts that actually exist on this host. LUNs backed by our vdis which
+// are mounted are adopted, the others are torn down.
+func (d SheepdogDriver) reconcile() {
+	log.Info("Start reconcile")
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		log.Error("Failed to read mountinfo, skip reconcile: ", err)
+		return
+	}
+
+	attached := make(map[string]bool)
+	removed := 0
+	for _, l := range tgtLunList(d.Runner, d.Conf.TargetID) {
+		// unix:/var/lib/sheepdog/sock:dvp-vol1, tcp:127.0.0.1:7000:dvp-vol1
+		vdiname := l.BackingStore[strings.LastIndex(l.BackingStore, ":")+1:]
+		name := d.volumeName(vdiname)
+		if name == "" {
+			continue
+		}
+		mountpoint := filepath.Join(d.Conf.MountPoint, name)
+		device, err := filepath.EvalSymlinks(iscsiByPath(d.Conf.TargetBindIP, d.Conf.TargetBindPort, d.Conf.TargetIqn, l.Lun))
+		if err != nil {
+			device = ""
+		}
+
+		if _, ok := mounts[mountpoint]; ok {
+			attached[name] = true
+			vs := d.State.volume(name)
+			if len(vs.IDs) == 0 {
+				log.Infof("Reconcile: %s is mounted on %s without known holders, adopting it as %q", name, mountpoint, orphanMountID)
+				vs.IDs[orphanMountID] = true
+			}
+			if vs.Lun != l.Lun {
+				log.Infof("Reconcile: %s LUN %q -> %q", name, vs.Lun, l.Lun)
+				vs.Lun = l.Lun
+			}
+			if device != "" && vs.Device != device {
+				log.Infof("Reconcile: %s device %q -> %q", name, vs.Device, device)
+				vs.Device = device
+			}
+			d.adoptLock(vdiname)
+			continue
+		}
+
+		log.Infof("Reconcile: LUN %s (%s) is not mounted, removing it", l.Lun, vdiname)
+		if device != "" {
+			log.Infof("Reconcile: deleting device %s", device)
+			if err := iscsiDeleteDevice(d.Runner, filepath.Base(device)); err != nil {
+				log.Error("Reconcile: failed to delete device: ", err)
+			}
+		}
+		if err := tgtLunDelete(d.Runner, d.Conf.TargetID, l.Lun); err != nil {
+			log.Error("Reconcile: failed to delete LUN: ", err)
+		}
+		d.unlockVolume(vdiname)
+		removed++
+	}
+
+	for name, vs := range d.State.Volumes {
+		if attached[name] == true {
+			continue
+		}
+		if _, ok := mounts[filepath.Join(d.Conf.MountPoint, name)]; ok {
+			log.Warningf("Reconcile: %s is mounted but has no LUN, keeping its state", name)
+			continue
+		}
+		log.Infof("Reconcile: %s is not attached, dropping its state (holders %v)", name, vs.IDs)
+		d.unlockVolume(d.vdiName(name))
+		delete(d.State.Volumes, name)
+	}
+
+	if removed > 0 {
+		iscsiRescan(d.Runner)
+	}
+	d.saveState()
+	log.Infof("Finished reconcile: %d volume(s) attached, %d LUN(s) removed", len(d.State.Volumes), removed)
+}
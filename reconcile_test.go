@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeMountInfo makes readMountInfo see the mountpoints mounted,
+// until the returned function is called
+func fakeMountInfo(t *testing.T, dir string, mountpoints ...string) func() {
+	var content string
+	for i, mountpoint := range mountpoints {
+		content += "36 35 98:" + string('0'+rune(i)) + " / " + mountpoint + " rw,noatime shared:1 - xfs /dev/sdtest rw\n"
+	}
+	path := filepath.Join(dir, "mountinfo")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mountInfoPath = path
+	return func() { mountInfoPath = "/proc/self/mountinfo" }
+}
+
+// tgtShow lists the luns of target 1 with their backing store
+func tgtShow(stores map[string]string) string {
+	out := "Target 1: iqn.2017-09.org.sheepdog-docker\n" +
+		"    LUN: 0\n" +
+		"        Type: controller\n" +
+		"        Backing store path: None\n"
+	for _, lun := range []string{"1", "2", "3"} {
+		if store, ok := stores[lun]; ok {
+			out += "    LUN: " + lun + "\n" +
+				"        Type: disk\n" +
+				"        Backing store path: " + store + "\n"
+		}
+	}
+	return out
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	cases := map[string]string{
+		"/mnt/sheepdog/vol1":       "/mnt/sheepdog/vol1",
+		`/mnt/sheepdog/my\040vol`:  "/mnt/sheepdog/my vol",
+		`/mnt/sheepdog/tab\011x`:   "/mnt/sheepdog/tab\tx",
+		`/mnt/sheepdog/back\134sl`: `/mnt/sheepdog/back\sl`,
+		`/mnt/sheepdog/bad\09`:     `/mnt/sheepdog/bad\09`,
+	}
+	for in, want := range cases {
+		if got := unescapeMountInfo(in); got != want {
+			t.Errorf("%s: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	defer fakeMountInfo(t, dir, filepath.Join(dir, "mnt", "vol1"))()
+
+	d.State.attach("vol1", "c1")
+	d.State.attach("vol1", "c2")
+	d.State.volume("vol1").Lun = "3"
+	d.State.attach("vol2", "c3")
+	d.State.volume("vol2").Lun = "2"
+	d.State.attach("vol3", "c4")
+	f.on("--op show", tgtShow(map[string]string{
+		"1": "unix:/var/lib/sheepdog/sock:dvp-vol1",
+		"2": "unix:/var/lib/sheepdog/sock:dvp-vol2",
+		"3": "unix:/var/lib/sheepdog/sock:other-vol3",
+	}))
+	d.reconcile()
+
+	// mounted: adopted with the lun found, keeping its holders
+	if vs := d.State.Volumes["vol1"]; vs == nil || vs.Lun != "1" || vs.IDs["c1"] == false || len(vs.IDs) != 2 {
+		t.Errorf("vol1: %+v", vs)
+	}
+	// lun without a mount: torn down
+	expectCalls(t, f, "--op delete --tid 1 --lun 2", "--rescan")
+	if _, ok := d.State.Volumes["vol2"]; ok {
+		t.Errorf("vol2 kept: %+v", d.State.Volumes["vol2"])
+	}
+	// not attached at all: forgotten
+	if _, ok := d.State.Volumes["vol3"]; ok {
+		t.Errorf("vol3 kept: %+v", d.State.Volumes["vol3"])
+	}
+	// the luns of other vdis are left alone
+	if len(f.called("--op delete")) != 1 {
+		t.Errorf("luns deleted: %q", f.called("--op delete"))
+	}
+
+	loaded, err := loadState(filepath.Join(dir, "state", "state.json"))
+	if err != nil || len(loaded.Volumes) != 1 || loaded.count("vol1") != 2 {
+		t.Errorf("saved state: %+v, %v", loaded.Volumes, err)
+	}
+}
+
+func TestReconcileAdoptsUncounted(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	defer fakeMountInfo(t, dir, filepath.Join(dir, "mnt", "vol1"))()
+
+	// a volume mounted while the state was lost
+	f.on("--op show", tgtShow(map[string]string{"1": "unix:/var/lib/sheepdog/sock:dvp-vol1"}))
+	d.reconcile()
+	if vs := d.State.Volumes["vol1"]; vs == nil || vs.Lun != "1" || len(vs.IDs) != 1 || vs.IDs[orphanMountID] == false {
+		t.Errorf("vol1: %+v", vs)
+	}
+	if len(f.called("--op delete")) != 0 || len(f.called("--rescan")) != 0 {
+		t.Errorf("torn down: %q", f.calls)
+	}
+}
+
+func TestReconcileLocks(t *testing.T) {
+	d, s, dir := newLockDriver(t)
+	defer os.RemoveAll(dir)
+	defer fakeMountInfo(t, dir, filepath.Join(dir, "mnt", "vol1"))()
+
+	old := `{"Host":"host1","Time":"2017-10-03T00:00:00Z"}`
+	s.set("dvp-vol1", old)
+	s.set("dvp-vol2", old)
+	d.State.attach("vol1", "c1")
+	d.State.attach("vol2", "c2")
+	d.State.volume("vol2").Lun = "2"
+	s.on("--op show", tgtShow(map[string]string{
+		"1": "unix:/var/lib/sheepdog/sock:dvp-vol1",
+		"2": "unix:/var/lib/sheepdog/sock:dvp-vol2",
+	}))
+	d.reconcile()
+
+	// mounted: the lock is renewed and kept renewed
+	if value := s.lock("dvp-vol1"); value == old || strings.Contains(value, `"Host":"host1"`) == false {
+		t.Errorf("adopted lock: %q", value)
+	}
+	if d.Locks.held["dvp-vol1"] == false {
+		t.Errorf("adopted lock not held: %v", d.Locks.held)
+	}
+	// torn down: released
+	if s.lock("dvp-vol2") != "" || d.Locks.held["dvp-vol2"] == true {
+		t.Errorf("lock of a torn down volume: %q, held %v", s.lock("dvp-vol2"), d.Locks.held)
+	}
+}
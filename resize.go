@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// resizeVolume grows the vdi behind the volume name to size.
+// When the volume is mounted on this host, the iSCSI device is rescanned
+// and the filesystem is grown online. Otherwise the filesystem is grown
+// the next time the volume is mounted. A volume attached on another host
+// has to be resized there.
+func (d SheepdogDriver) resizeVolume(name, size string) error {
+	log.Infof("Resize: %s to %s", name, size)
+
+	if err := d.validateVolumeName(name); err != nil {
+		return err
+	}
+	newsize, err := parseSize(size)
+	if err != nil {
+		return errors.New("Invalid size: " + size)
+	}
+	vdiname := d.vdiName(name)
+	if d.vdiExist(vdiname) == false {
+		return errors.New("Volume Not Found: " + name)
+	}
+	if err := d.checkNamespace(d.readVolumeOptions(vdiname)); err != nil {
+		return err
+	}
+	if lock, ok, err := d.readLock(vdiname); err != nil {
+		return err
+	} else if ok && lock.Host != d.Conf.Hostname {
+		return errors.New("Volume is attached on host " + lock.Host + ", resize it there")
+	}
+	if err := d.checkQuota(vdiname, newsize); err != nil {
+		return err
+	}
+
+	err = dogVdiResize(d.Runner, vdiname, size, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err != nil {
+		log.Error("Error dogVdiResize: ", err)
+		return commandError("Failed to resize vdi", err)
+	}
+
+	mountpoint := filepath.Join(d.Conf.MountPoint, name)
+	if isAlreadyMountingThisVolume(d.Runner, mountpoint) == false {
+		log.Debug("Volume is not mounted on this host, skip growing filesystem")
+		return nil
+	}
+
+	scsi := getScsiNameFromDeviceName(d.Runner, mountpoint)
+	if scsi == "" {
+		return errors.New("Failed to find the device of volume " + name)
+	}
+	if err := scsiRescanDevice(d.Runner, scsi); err != nil {
+		return errors.New("Failed to rescan device " + scsi)
+	}
+	iscsiRescan(d.Runner)
+
+	device := "/dev/" + scsi
+	if err := growFilesystem(d.Runner, device, mountpoint, getFSType(d.Runner, device)); err != nil {
+		log.Error("Error growFilesystem: ", err)
+		return commandError("Failed to grow filesystem on "+device, err)
+	}
+	return nil
+}
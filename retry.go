@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RetryPolicy is the retry setting of an operation in the config.
+// Attempts counts the first try, 1 disables the retries.
+// The fields not set are taken from the "default" policy.
+type RetryPolicy struct {
+	Attempts int
+	Delay    string
+	MaxDelay string
+}
+
+// retryPolicy is a RetryPolicy with the durations parsed
+type retryPolicy struct {
+	attempts int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// defaultRetryPolicy waits up to 1s, 2s, 4s and 8s between five attempts
+var defaultRetryPolicy = retryPolicy{attempts: 5, delay: time.Second, maxDelay: 15 * time.Second}
+
+// retryOperations are the operations which are retried, the keys of Retries
+var retryOperations = []string{"default", "vdi create", "vdi delete", "vdi snapshot", "vdi clone", "lun new"}
+
+// transientOutputs are the messages of dog and tgtadm
+// for failures which go away once sheep or tgtd are back
+var transientOutputs = []string{
+	"failed to connect to",
+	"connection refused",
+	"transport endpoint is not connected",
+	"can't connect to the tgt daemon",
+	"system is still booting",
+	"waiting for other nodes to join cluster",
+	"io has halted as there are not enough living nodes",
+	"out of memory on server",
+}
+
+// parse applies p over base
+func (p RetryPolicy) parse(base retryPolicy) (retryPolicy, error) {
+	policy := base
+	if p.Attempts < 0 {
+		return policy, errors.New("Attempts can not be negative")
+	}
+	if p.Attempts > 0 {
+		policy.attempts = p.Attempts
+	}
+	if p.Delay != "" {
+		delay, err := time.ParseDuration(p.Delay)
+		if err != nil || delay <= 0 {
+			return policy, errors.New("Delay is not a valid duration: " + p.Delay)
+		}
+		policy.delay = delay
+	}
+	if p.MaxDelay != "" {
+		maxDelay, err := time.ParseDuration(p.MaxDelay)
+		if err != nil || maxDelay <= 0 {
+			return policy, errors.New("MaxDelay is not a valid duration: " + p.MaxDelay)
+		}
+		policy.maxDelay = maxDelay
+	}
+	return policy, nil
+}
+
+// retryPolicies returns the policy of every operation from Retries
+func retryPolicies(conf *Config) (map[string]retryPolicy, error) {
+	base, err := conf.Retries["default"].parse(defaultRetryPolicy)
+	if err != nil {
+		return nil, errors.New("default: " + err.Error())
+	}
+	policies := make(map[string]retryPolicy)
+	for _, op := range retryOperations {
+		policy, err := conf.Retries[op].parse(base)
+		if err != nil {
+			return nil, errors.New(op + ": " + err.Error())
+		}
+		policies[op] = policy
+	}
+	for op := range conf.Retries {
+		if _, ok := policies[op]; ok == false {
+			return nil, errors.New("unknown operation " + op)
+		}
+	}
+	return policies, nil
+}
+
+// backoff returns the wait before the retry following attempt n (from 1):
+// delay doubled at each attempt up to maxDelay, with a random jitter
+// taking off up to half of it so that hosts do not retry in step
+func (p retryPolicy) backoff(n int) time.Duration {
+	wait := p.delay
+	for i := 1; i < n && wait < p.maxDelay; i++ {
+		wait *= 2
+	}
+	if wait > p.maxDelay {
+		wait = p.maxDelay
+	}
+	half := int64(wait / 2)
+	if half <= 0 {
+		return wait
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// retryable tells whether err may go away by trying again.
+// A timed out command is not retried, it may have done its work.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *TimeoutError:
+		return false
+	case *SheepError:
+		switch e.Code {
+		case sdResStartup, sdResWaitForJoin, sdResHalt, sdResNoMem:
+			return true
+		}
+		return false
+	case *CommandError:
+		out := strings.ToLower(e.Output)
+		for _, msg := range transientOutputs {
+			if strings.Contains(out, msg) {
+				return true
+			}
+		}
+		return false
+	case *net.OpError:
+		// sheep not listening, the request was not sent
+		return e.Op == "dial"
+	}
+	return false
+}
+
+// retryGate keeps the requests changing volumes out while a retry waits
+// for sheep or tgtd. The driver mutex is released during the backoff so
+// Get, List and the admin API go on, but Create, Remove, Mount and Unmount
+// wait until the request retrying is done rather than run in its middle.
+type retryGate struct {
+	// on the driver mutex
+	cond     *sync.Cond
+	sleeping int
+}
+
+func newRetryGate(mu *sync.Mutex) *retryGate {
+	return &retryGate{cond: sync.NewCond(mu)}
+}
+
+// lockChanges takes the driver mutex for a request changing volumes,
+// once no retry is waiting
+func (d SheepdogDriver) lockChanges() {
+	d.Mutex.Lock()
+	if d.Gate == nil {
+		return
+	}
+	for d.Gate.sleeping > 0 {
+		d.Gate.cond.Wait()
+	}
+}
+
+// backoffSleep waits before a retry with the driver mutex released
+func (d SheepdogDriver) backoffSleep(wait time.Duration) {
+	if d.Gate == nil {
+		time.Sleep(wait)
+		return
+	}
+	d.Gate.sleeping++
+	d.Mutex.Unlock()
+	time.Sleep(wait)
+	d.Mutex.Lock()
+	d.Gate.sleeping--
+	d.Gate.cond.Broadcast()
+}
+
+// retry runs fn until it succeeds, fails with an error which is not
+// retryable or the attempts of the operation op are used up.
+// The caller holds the driver mutex, it is released while waiting.
+// Only the failures which did not reach sheep or tgtd are retryable,
+// so a failed attempt did nothing and an existing or missing vdi found
+// by the next one is an error.
+func (d SheepdogDriver) retry(op string, fn func() error) error {
+	policy, ok := d.Retries[op]
+	if ok == false {
+		policy = defaultRetryPolicy
+	}
+	var err error
+	for n := 1; ; n++ {
+		err = fn()
+		if err == nil || retryable(err) == false {
+			return err
+		}
+		if n >= policy.attempts {
+			log.Errorf("Giving up %s after %d attempts: %v", op, n, err)
+			return err
+		}
+		wait := policy.backoff(n)
+		log.Warningf("Retrying %s in %s (attempt %d of %d): %v", op, wait, n+1, policy.attempts, err)
+		d.backoffSleep(wait)
+	}
+}
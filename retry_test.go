@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", &TimeoutError{Command: "dog vdi create", Timeout: time.Minute}, false},
+		{"sheep starting", &SheepError{Op: "create", Code: sdResStartup}, true},
+		{"sheep waiting for nodes", &SheepError{Op: "create", Code: sdResWaitForJoin}, true},
+		{"sheep halted", &SheepError{Op: "create", Code: sdResHalt}, true},
+		{"sheep out of memory", &SheepError{Op: "create", Code: sdResNoMem}, true},
+		{"vdi exists", &SheepError{Op: "create", Code: sdResVdiExist}, false},
+		{"dog not connected", &CommandError{Command: "dog vdi create", Output: "Failed to connect to 127.0.0.1:7000: Connection refused"}, true},
+		{"tgtd restarting", &CommandError{Command: "tgtadm", Output: "tgtadm: can't connect to the tgt daemon"}, true},
+		{"dog vdi exists", &CommandError{Command: "dog vdi create", Output: "VDI exists already"}, false},
+		{"sheep not listening", &net.OpError{Op: "dial", Net: "unix", Err: errors.New("connection refused")}, true},
+		{"connection lost", &net.OpError{Op: "read", Net: "unix", Err: errors.New("connection reset by peer")}, false},
+		{"other", errors.New("Failed to create vdi"), false},
+	}
+	for _, c := range cases {
+		if got := retryable(c.err); got != c.want {
+			t.Errorf("%s: retryable %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{attempts: 5, delay: time.Second, maxDelay: 5 * time.Second}
+	cases := []struct {
+		n    int
+		wait time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			if got := p.backoff(c.n); got < c.wait/2 || got > c.wait {
+				t.Fatalf("attempt %d: backoff %v, want %v to %v", c.n, got, c.wait/2, c.wait)
+			}
+		}
+	}
+}
+
+func TestRetryPolicies(t *testing.T) {
+	conf := Config{Retries: map[string]RetryPolicy{
+		"default":    {Delay: "100ms"},
+		"vdi create": {Attempts: 2, MaxDelay: "1s"},
+	}}
+	policies, err := retryPolicies(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := retryPolicy{attempts: 2, delay: 100 * time.Millisecond, maxDelay: time.Second}
+	if policies["vdi create"] != want {
+		t.Errorf("vdi create: %+v, want %+v", policies["vdi create"], want)
+	}
+	want = retryPolicy{attempts: defaultRetryPolicy.attempts, delay: 100 * time.Millisecond, maxDelay: defaultRetryPolicy.maxDelay}
+	if policies["lun new"] != want {
+		t.Errorf("lun new: %+v, want %+v", policies["lun new"], want)
+	}
+
+	for _, retries := range []map[string]RetryPolicy{
+		{"vdi resize": {Attempts: 2}},
+		{"default": {Attempts: -1}},
+		{"lun new": {Delay: "soon"}},
+		{"vdi delete": {MaxDelay: "-1s"}},
+	} {
+		if _, err := retryPolicies(&Config{Retries: retries}); err == nil {
+			t.Errorf("%v: accepted", retries)
+		}
+	}
+}
+
+func TestDriverRetry(t *testing.T) {
+	f := &fakeRunner{}
+	d, dir := newTestDriver(t, f)
+	defer os.RemoveAll(dir)
+	d.Retries = map[string]retryPolicy{"vdi create": {attempts: 3, delay: time.Millisecond, maxDelay: time.Millisecond}}
+
+	// sheep comes back at the second attempt
+	f.onceFail("dog vdi create", "Failed to connect to 127.0.0.1:7000: Connection refused")
+	if r := d.Create(volume.Request{Name: "vol1"}); r.Err != "" {
+		t.Fatal("Create: ", r.Err)
+	}
+	if n := len(f.called("dog vdi create")); n != 2 {
+		t.Errorf("Create: %d attempts", n)
+	}
+
+	// a failure which is not transient is not retried
+	f.reset()
+	f.fail("dog vdi create", "VDI exists already")
+	if r := d.Create(volume.Request{Name: "vol2"}); r.Err == "" {
+		t.Error("Create succeeded")
+	}
+	if n := len(f.called("dog vdi create")); n != 1 {
+		t.Errorf("Create: %d attempts", n)
+	}
+
+	// a retry finding the vdi is not taken as done, it may be another one
+	f.reset()
+	f.onceFail("dog vdi create", "Failed to connect to 127.0.0.1:7000: Connection refused")
+	f.fail("dog vdi create", "VDI exists already")
+	if r := d.Create(volume.Request{Name: "vol3"}); r.Err == "" {
+		t.Error("Create succeeded on an existing vdi")
+	}
+}
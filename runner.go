@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Runner executes the external commands (sudo, dog, tgtadm, iscsiadm ...)
+// the driver depends on. Every helper in utils.go goes through it, so an
+// alternative implementation can stand in for the real host commands.
+type Runner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// timeoutRunner is a Runner whose command timeouts come from the config
+type timeoutRunner interface {
+	SetTimeouts(timeouts map[string]time.Duration)
+}
+
+// defaultCommandTimeout applies to the commands without a timeout of their own
+const defaultCommandTimeout = 2 * time.Minute
+
+// defaultCommandTimeouts are the timeouts of every command the driver
+// runs, by command label (see commandLabel), and the keys accepted in
+// CommandTimeouts. "default" is for the commands not listed and "sheep"
+// for the requests of the native client.
+var defaultCommandTimeouts = map[string]time.Duration{
+	"default": defaultCommandTimeout,
+	"sheep":   30 * time.Second,
+
+	"dog cluster info": defaultCommandTimeout,
+	"dog vdi list":     defaultCommandTimeout,
+	"dog vdi create":   30 * time.Minute, // prealloc writes every object
+	"dog vdi delete":   defaultCommandTimeout,
+	"dog vdi snapshot": defaultCommandTimeout,
+	"dog vdi clone":    defaultCommandTimeout,
+	"dog vdi resize":   defaultCommandTimeout,
+	"dog vdi getattr":  defaultCommandTimeout,
+	"dog vdi setattr":  defaultCommandTimeout,
+
+	"tgtadm":   defaultCommandTimeout,
+	"iscsiadm": defaultCommandTimeout,
+	"lsblk":    defaultCommandTimeout,
+	"blkid":    defaultCommandTimeout,
+	"ls":       defaultCommandTimeout,
+	"mkdir":    defaultCommandTimeout,
+	"mount":    defaultCommandTimeout,
+	"umount":   defaultCommandTimeout,
+	"pidof":    defaultCommandTimeout,
+
+	"mkfs.xfs":   30 * time.Minute,
+	"mkfs.ext4":  30 * time.Minute,
+	"mkfs.btrfs": 30 * time.Minute,
+	"resize2fs":  30 * time.Minute,
+	"xfs_growfs": 10 * time.Minute,
+	"btrfs":      10 * time.Minute,
+}
+
+// outputGrace is how long the output of a command is read after it
+// exited, a process it left in the background may hold the pipe open
+const outputGrace = time.Second
+
+// TimeoutError is returned when a command did not finish in time
+// and was killed
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Command, e.Timeout)
+}
+
+// CommandError is returned when a command exits with an error,
+// it keeps the output to tell transient failures from permanent ones
+type CommandError struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	lines := strings.Split(strings.TrimSpace(e.Output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Sprintf("%s: %v: %s", e.Command, e.Err, last)
+	}
+	return fmt.Sprintf("%s: %v", e.Command, e.Err)
+}
+
+// commandError is the error returned to Docker for a failed command.
+// A timeout is reported as such, other failures only as msg since
+// the details are in the log.
+func commandError(msg string, err error) error {
+	if te, ok := err.(*TimeoutError); ok {
+		return errors.New(msg + ": " + te.Error())
+	}
+	return errors.New(msg)
+}
+
+// execRunner runs commands on this host
+type execRunner struct {
+	mu       sync.RWMutex
+	timeouts map[string]time.Duration
+}
+
+// SetTimeouts replaces the command timeouts, by command label
+func (r *execRunner) SetTimeouts(timeouts map[string]time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeouts = timeouts
+}
+
+// timeout returns the timeout of the command label
+func (r *execRunner) timeout(label string) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if t, ok := r.timeouts[label]; ok {
+		return t
+	}
+	if t, ok := r.timeouts["default"]; ok {
+		return t
+	}
+	return defaultCommandTimeout
+}
+
+// Run executes the command and returns its combined stdout and stderr.
+// The command runs in a process group of its own, the whole group is
+// killed when it does not finish in time, sudo and its child included.
+// The output goes through a pipe of our own, so waiting for the command
+// does not wait for the processes it left holding the pipe.
+func (r *execRunner) Run(name string, args ...string) ([]byte, error) {
+	label := commandLabel(name, args)
+	timeout := r.timeout(label)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&out, pr)
+		close(copied)
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		drainOutput(pr, copied)
+		if _, ok := err.(*exec.ExitError); ok {
+			return out.Bytes(), &CommandError{Command: label, Output: out.String(), Err: err}
+		}
+		return out.Bytes(), err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		drainOutput(pr, copied)
+		return out.Bytes(), &TimeoutError{Command: label, Timeout: timeout}
+	}
+}
+
+// drainOutput waits up to outputGrace for the output of an exited
+// command to be copied, then closes the pipe
+func drainOutput(pr *os.File, copied chan struct{}) {
+	select {
+	case <-copied:
+	case <-time.After(outputGrace):
+		log.Debug("Output pipe still open after the command exited, closing it")
+	}
+	pr.Close()
+	<-copied
+}
+
+// commandTimeouts returns the default timeouts overridden by CommandTimeouts
+func commandTimeouts(conf *Config) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for command, timeout := range defaultCommandTimeouts {
+		timeouts[command] = timeout
+	}
+	for command, value := range conf.CommandTimeouts {
+		if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+			timeouts[command] = timeout
+		}
+	}
+	return timeouts
+}
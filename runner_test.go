@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecRunner(t *testing.T) {
+	r := &execRunner{}
+	out, err := r.Run("sh", "-c", "echo out; echo err >&2")
+	if err != nil || string(out) != "out\nerr\n" {
+		t.Errorf("Run: %q, %v", out, err)
+	}
+	if _, err := r.Run("sh", "-c", "exit 3"); err == nil {
+		t.Error("a failed command succeeded")
+	}
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	r := &execRunner{}
+	r.SetTimeouts(map[string]time.Duration{"default": time.Minute, "sleep": 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := r.Run("sleep", "5")
+	if te, ok := err.(*TimeoutError); ok == false || te.Command != "sleep" || te.Timeout != 50*time.Millisecond {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the command ran for %s", elapsed)
+	}
+	if err := commandError("Failed to create vdi", err); err.Error() != "Failed to create vdi: sleep timed out after 50ms" {
+		t.Errorf("commandError: %v", err)
+	}
+}
+
+func TestCommandTimeouts(t *testing.T) {
+	conf := &Config{CommandTimeouts: map[string]string{
+		"default":  "5m",
+		"mkfs.xfs": "1h",
+		"tgtadm":   "10s",
+	}}
+	timeouts := commandTimeouts(conf)
+	want := map[string]time.Duration{
+		"default":    5 * time.Minute,
+		"mkfs.xfs":   time.Hour,
+		"tgtadm":     10 * time.Second,
+		"mkfs.ext4":  30 * time.Minute,
+		"xfs_growfs": 10 * time.Minute,
+	}
+	for label, timeout := range want {
+		if timeouts[label] != timeout {
+			t.Errorf("%s: %s, want %s", label, timeouts[label], timeout)
+		}
+	}
+}
+
+func TestCommandLabel(t *testing.T) {
+	cases := []struct {
+		name  string
+		args  []string
+		label string
+	}{
+		{"sudo", []string{"dog", "vdi", "create", "-v", "dvp-vol1", "1G"}, "dog vdi create"},
+		{"sudo", []string{"tgtadm", "--lld", "iscsi"}, "tgtadm"},
+		{"/usr/sbin/mkfs.xfs", []string{"-f", "/dev/sdb"}, "mkfs.xfs"},
+		{"dog", []string{"node"}, "dog"},
+		{"sudo", nil, "sudo"},
+	}
+	for _, c := range cases {
+		if got := commandLabel(c.name, c.args); got != c.label {
+			t.Errorf("%s %v: %q, want %q", c.name, c.args, got, c.label)
+		}
+	}
+}
+
+func TestExecRunnerLeftoverProcess(t *testing.T) {
+	r := &execRunner{}
+	r.SetTimeouts(map[string]time.Duration{"default": time.Minute, "sh": 200 * time.Millisecond})
+
+	// the backgrounded sleep keeps the output pipe open after sh exited
+	start := time.Now()
+	out, err := r.Run("sh", "-c", "sleep 2 & echo started")
+	if err != nil || string(out) != "started\n" {
+		t.Errorf("Run: %q, %v", out, err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+outputGrace+500*time.Millisecond {
+		t.Errorf("waited %s for the leftover process", elapsed)
+	}
+}
+
+// TestProcessConfigTimeouts loads the config of DVP_TEST_CONFIG
+// in a child process, since processConfig exits on errors
+func TestProcessConfigTimeouts(t *testing.T) {
+	if cfg := os.Getenv("DVP_TEST_CONFIG"); cfg != "" {
+		processConfig(cfg)
+		os.Exit(0)
+	}
+
+	dir, err := ioutil.TempDir("", "dvp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		timeouts string
+		ok       bool
+	}{
+		{`{"dog vdi create": "1h", "default": "5m"}`, true},
+		{`{"dog vdi craete": "1h"}`, false},
+		{`{"mkfs.xfs": "soon"}`, false},
+		{`{"mkfs.xfs": "-1m"}`, false},
+	}
+	for i, c := range cases {
+		cfg := filepath.Join(dir, fmt.Sprintf("config%d.json", i))
+		content := `{"MountPoint": "` + filepath.Join(dir, "mnt") + `", "StateDir": "` + filepath.Join(dir, "state") + `",
+			"CommandTimeouts": ` + c.timeouts + `}`
+		if err := ioutil.WriteFile(cfg, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestProcessConfigTimeouts$")
+		cmd.Env = append(os.Environ(), "DVP_TEST_CONFIG="+cfg)
+		out, err := cmd.CombinedOutput()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: %v\n%s", c.timeouts, err, out)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Constants taken from sheepdog's include/sheepdog_proto.h
+const (
+	sdProtoVer = 0x02
+
+	sdOpReadObj  = 0x02
+	sdOpNewVdi   = 0x11
+	sdOpGetVdi   = 0x14
+	sdOpReadVdis = 0x15
+	sdOpDelVdi   = 0x17
+
+	sdFlagCmdWrite = 0x01
+
+	sdMaxVdiLen    = 256
+	sdMaxVdiTagLen = 256
+	sdNrVdis       = 1 << 24
+	sdVdiBit       = uint64(1) << 63
+
+	// sd_inode up to and including parent_vdi_id
+	sdInodeHeaderLen = 568
+
+	sheepDialTimeout = 10 * time.Second
+)
+
+// Result codes returned by sheep
+const (
+	sdResSuccess      = 0x00
+	sdResUnknown      = 0x01
+	sdResNoObj        = 0x02
+	sdResEIO          = 0x03
+	sdResVdiExist     = 0x04
+	sdResInvalidParms = 0x05
+	sdResSystemError  = 0x06
+	sdResVdiLocked    = 0x07
+	sdResNoVdi        = 0x08
+	sdResNoBaseVdi    = 0x09
+	sdResVdiRead      = 0x0A
+	sdResVdiWrite     = 0x0B
+	sdResBaseVdiRead  = 0x0C
+	sdResBaseVdiWrite = 0x0D
+	sdResNoTag        = 0x0E
+	sdResStartup      = 0x0F
+	sdResVdiNotLocked = 0x10
+	sdResShutdown     = 0x11
+	sdResNoMem        = 0x12
+	sdResFullVdi      = 0x13
+	sdResVerMismatch  = 0x14
+	sdResNoSpace      = 0x15
+	sdResWaitForFmt   = 0x16
+	sdResWaitForJoin  = 0x17
+	sdResJoinFailed   = 0x18
+	sdResHalt         = 0x19
+	sdResReadonly     = 0x1A
+)
+
+var sdResMessages = map[uint32]string{
+	sdResSuccess:      "Success",
+	sdResUnknown:      "Unknown error",
+	sdResNoObj:        "No object found",
+	sdResEIO:          "I/O error",
+	sdResVdiExist:     "VDI exists already",
+	sdResInvalidParms: "Invalid parameters",
+	sdResSystemError:  "System error",
+	sdResVdiLocked:    "VDI is already locked",
+	sdResNoVdi:        "No VDI found",
+	sdResNoBaseVdi:    "No base VDI found",
+	sdResVdiRead:      "Failed to read from requested VDI",
+	sdResVdiWrite:     "Failed to write to requested VDI",
+	sdResBaseVdiRead:  "Failed to read from base VDI",
+	sdResBaseVdiWrite: "Failed to write to base VDI",
+	sdResNoTag:        "Failed to find requested tag",
+	sdResStartup:      "System is still booting",
+	sdResVdiNotLocked: "VDI is not locked",
+	sdResShutdown:     "System is shutting down",
+	sdResNoMem:        "Out of memory on server",
+	sdResFullVdi:      "Maximum number of VDIs reached",
+	sdResVerMismatch:  "Protocol version mismatch",
+	sdResNoSpace:      "Server has no space for new objects",
+	sdResWaitForFmt:   "Waiting for cluster to be formatted",
+	sdResWaitForJoin:  "Waiting for other nodes to join cluster",
+	sdResJoinFailed:   "Node has failed to join cluster",
+	sdResHalt:         "IO has halted as there are not enough living nodes",
+	sdResReadonly:     "Object is read-only",
+}
+
+// SheepError is returned when sheep answers a request with a result
+// other than SD_RES_SUCCESS
+type SheepError struct {
+	Op   string
+	Code uint32
+}
+
+func (e *SheepError) Error() string {
+	msg, ok := sdResMessages[e.Code]
+	if !ok {
+		msg = fmt.Sprintf("result 0x%x", e.Code)
+	}
+	return fmt.Sprintf("sheep %s: %s", e.Op, msg)
+}
+
+// isSheepResult reports whether err is a SheepError carrying code
+func isSheepResult(err error, code uint32) bool {
+	serr, ok := err.(*SheepError)
+	return ok && serr.Code == code
+}
+
+// sdReq is struct sd_req, the 48 byte request header
+type sdReq struct {
+	ProtoVer   uint8
+	Opcode     uint8
+	Flags      uint16
+	Epoch      uint32
+	ID         uint32
+	DataLength uint32
+	Args       [32]byte
+}
+
+// sdRsp is struct sd_rsp, the 48 byte response header
+type sdRsp struct {
+	ProtoVer   uint8
+	Opcode     uint8
+	Flags      uint16
+	Epoch      uint32
+	ID         uint32
+	DataLength uint32
+	Result     uint32
+	Args       [28]byte
+}
+
+// vdiArgs fills the vdi member of the sd_req union
+func (r *sdReq) vdiArgs(size uint64, baseVid uint32, copies, copyPolicy, storePolicy, bsize uint8, snapid uint32) {
+	binary.LittleEndian.PutUint64(r.Args[0:], size)
+	binary.LittleEndian.PutUint32(r.Args[8:], baseVid)
+	r.Args[12] = copies
+	r.Args[13] = copyPolicy
+	r.Args[14] = storePolicy
+	r.Args[15] = bsize
+	binary.LittleEndian.PutUint32(r.Args[16:], snapid)
+}
+
+// objArgs fills the obj member of the sd_req union
+func (r *sdReq) objArgs(oid uint64, offset uint64) {
+	binary.LittleEndian.PutUint64(r.Args[0:], oid)
+	binary.LittleEndian.PutUint64(r.Args[24:], offset)
+}
+
+// vdiID reads vdi.vdi_id from the sd_rsp union
+func (r *sdRsp) vdiID() uint32 {
+	return binary.LittleEndian.Uint32(r.Args[4:])
+}
+
+// SheepInode holds the header fields of a VDI inode object
+type SheepInode struct {
+	Name           string
+	Tag            string
+	CreateTime     time.Time
+	SnapCtime      uint64
+	VdiSize        uint64
+	CopyPolicy     uint8
+	StorePolicy    uint8
+	NrCopies       uint8
+	BlockSizeShift uint8
+	SnapID         uint32
+	VdiID          uint32
+	ParentVdiID    uint32
+}
+
+// IsSnapshot reports whether the inode belongs to a snapshot
+func (i *SheepInode) IsSnapshot() bool {
+	return i.SnapCtime != 0
+}
+
+// Redundancy returns the redundancy scheme the way dog prints it
+// e.g. "3" for replication, "4:2" for erasure coding
+func (i *SheepInode) Redundancy() string {
+	if i.CopyPolicy == 0 {
+		return strconv.Itoa(int(i.NrCopies))
+	}
+	return fmt.Sprintf("%d:%d", i.CopyPolicy>>4, i.CopyPolicy&0x0f)
+}
+
+func parseInode(buf []byte) *SheepInode {
+	le := binary.LittleEndian
+	ctime := le.Uint64(buf[512:])
+	return &SheepInode{
+		Name:           cString(buf[0:sdMaxVdiLen]),
+		Tag:            cString(buf[sdMaxVdiLen : sdMaxVdiLen+sdMaxVdiTagLen]),
+		CreateTime:     time.Unix(int64(ctime>>32), int64(ctime&0xffffffff)),
+		SnapCtime:      le.Uint64(buf[520:]),
+		VdiSize:        le.Uint64(buf[536:]),
+		CopyPolicy:     buf[552],
+		StorePolicy:    buf[553],
+		NrCopies:       buf[554],
+		BlockSizeShift: buf[555],
+		SnapID:         le.Uint32(buf[556:]),
+		VdiID:          le.Uint32(buf[560:]),
+		ParentVdiID:    le.Uint32(buf[564:]),
+	}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// vdiNameTag builds the name + tag payload used by GET_VDI_INFO and DEL_VDI
+func vdiNameTag(name, tag string) []byte {
+	buf := make([]byte, sdMaxVdiLen+sdMaxVdiTagLen)
+	copy(buf[:sdMaxVdiLen-1], name)
+	copy(buf[sdMaxVdiLen:sdMaxVdiLen+sdMaxVdiTagLen-1], tag)
+	return buf
+}
+
+// SheepClient speaks the sheep request/response protocol directly,
+// without going through the dog command
+type SheepClient struct {
+	Network string
+	Address string
+	// deadline of a whole request, no deadline when zero
+	Timeout time.Duration
+}
+
+// newSheepClient returns a client for the sheep configured in conf,
+// the remote sheep when RemoteSheep is set, the local socket otherwise
+func newSheepClient(conf *Config) *SheepClient {
+	timeout := commandTimeouts(conf)["sheep"]
+	if conf.RemoteSheep == true {
+		return &SheepClient{Network: "tcp", Address: net.JoinHostPort(conf.RemoteSheepIP, conf.RemoteSheepPort), Timeout: timeout}
+	}
+	return &SheepClient{Network: "unix", Address: conf.LocalSheepSocket, Timeout: timeout}
+}
+
+// do sends a single request and returns the response header and payload.
+// wdata is sent along with write requests, rlen is the size of the
+// buffer announced for read requests.
+func (c *SheepClient) do(op string, req *sdReq, wdata []byte, rlen uint32) (*sdRsp, []byte, error) {
+	rsp, data, err := c.exchange(op, req, wdata, rlen)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() == true && c.Timeout > 0 {
+		return rsp, data, &TimeoutError{Command: "sheep " + op, Timeout: c.Timeout}
+	}
+	return rsp, data, err
+}
+
+// exchange writes the request and reads the response on a new connection
+func (c *SheepClient) exchange(op string, req *sdReq, wdata []byte, rlen uint32) (*sdRsp, []byte, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, sheepDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	req.ProtoVer = sdProtoVer
+	if req.Flags&sdFlagCmdWrite != 0 {
+		req.DataLength = uint32(len(wdata))
+	} else {
+		req.DataLength = rlen
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, req)
+	buf.Write(wdata)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	var rsp sdRsp
+	if err := binary.Read(conn, binary.LittleEndian, &rsp); err != nil {
+		return nil, nil, err
+	}
+	var data []byte
+	if rsp.DataLength > 0 {
+		data = make([]byte, rsp.DataLength)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if rsp.Result != sdResSuccess {
+		return &rsp, data, &SheepError{Op: op, Code: rsp.Result}
+	}
+	return &rsp, data, nil
+}
+
+// Lookup returns the vdi id of name, or of its snapshot when tag or
+// snapid is given
+func (c *SheepClient) Lookup(name, tag string, snapid uint32) (uint32, error) {
+	log.Debugf("Begin sheep.Lookup: %s, %s, %d", name, tag, snapid)
+	req := &sdReq{Opcode: sdOpGetVdi, Flags: sdFlagCmdWrite}
+	req.vdiArgs(0, 0, 0, 0, 0, 0, snapid)
+	rsp, _, err := c.do("lookup", req, vdiNameTag(name, tag), 0)
+	if err != nil {
+		return 0, err
+	}
+	return rsp.vdiID(), nil
+}
+
+// Exist reports whether a vdi called name exists
+func (c *SheepClient) Exist(name string) (bool, error) {
+	_, err := c.Lookup(name, "", 0)
+	if isSheepResult(err, sdResNoVdi) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Create creates a new vdi.
+// It understands the same opts as dogVdiCreate except prealloc,
+// which dog implements by writing every data object from the client.
+func (c *SheepClient) Create(name, size string, opts map[string]string) (uint32, error) {
+	log.Debugf("Begin sheep.Create: %s, %s", name, size)
+	if opts["prealloc"] == "true" {
+		return 0, errors.New("prealloc is not supported by the native sheep client")
+	}
+	vdiSize, err := parseSize(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var copies, copyPolicy, storePolicy, bsize uint8
+	if opts["copies"] != "" {
+		copies, copyPolicy, err = parseCopies(opts["copies"])
+		if err != nil {
+			return 0, err
+		}
+	}
+	if opts["hyper"] == "true" {
+		storePolicy = 1
+	}
+	if opts["bsize"] != "" {
+		n, err := strconv.ParseUint(opts["bsize"], 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("invalid block_size_shift: %s", opts["bsize"])
+		}
+		bsize = uint8(n)
+	}
+
+	req := &sdReq{Opcode: sdOpNewVdi, Flags: sdFlagCmdWrite}
+	req.vdiArgs(vdiSize, 0, copies, copyPolicy, storePolicy, bsize, 0)
+	data := make([]byte, sdMaxVdiLen)
+	copy(data[:sdMaxVdiLen-1], name)
+	rsp, _, err := c.do("create", req, data, 0)
+	if err != nil {
+		return 0, err
+	}
+	return rsp.vdiID(), nil
+}
+
+// Delete deletes the vdi called name
+func (c *SheepClient) Delete(name string) error {
+	log.Debugf("Begin sheep.Delete: %s", name)
+	req := &sdReq{Opcode: sdOpDelVdi, Flags: sdFlagCmdWrite}
+	_, _, err := c.do("delete", req, vdiNameTag(name, ""), 0)
+	return err
+}
+
+// ReadInode reads the inode header of the vdi with id vid
+func (c *SheepClient) ReadInode(vid uint32) (*SheepInode, error) {
+	req := &sdReq{Opcode: sdOpReadObj}
+	req.objArgs(sdVdiBit|uint64(vid)<<32, 0)
+	_, data, err := c.do("read inode", req, nil, sdInodeHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sdInodeHeaderLen {
+		return nil, fmt.Errorf("sheep read inode: short read (%d bytes)", len(data))
+	}
+	return parseInode(data), nil
+}
+
+// List returns the inodes of every vdi in the cluster, snapshots included
+func (c *SheepClient) List() ([]*SheepInode, error) {
+	log.Debugf("Begin sheep.List")
+	req := &sdReq{Opcode: sdOpReadVdis}
+	_, bitmap, err := c.do("read vdis", req, nil, sdNrVdis/8)
+	if err != nil {
+		return nil, err
+	}
+
+	var inodes []*SheepInode
+	for i, b := range bitmap {
+		if b == 0 {
+			continue
+		}
+		for bit := uint(0); bit < 8; bit++ {
+			if b&(1<<bit) == 0 {
+				continue
+			}
+			inode, err := c.ReadInode(uint32(i)*8 + uint32(bit))
+			if err != nil {
+				return nil, err
+			}
+			// deleted vdi
+			if inode.Name == "" {
+				continue
+			}
+			inodes = append(inodes, inode)
+		}
+	}
+	return inodes, nil
+}
+
+// parseSize converts a dog style size (10G, 512M, 1T ...) into bytes
+func parseSize(size string) (uint64, error) {
+	s := strings.TrimSpace(size)
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	var shift uint
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		shift = 10
+	case 'm', 'M':
+		shift = 20
+	case 'g', 'G':
+		shift = 30
+	case 't', 'T':
+		shift = 40
+	case 'p', 'P':
+		shift = 50
+	case 'e', 'E':
+		shift = 60
+	}
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	if n > (^uint64(0))>>shift {
+		return 0, fmt.Errorf("size is too large: %s", size)
+	}
+	return n << shift, nil
+}
+
+// parseCopies converts "3" or an erasure coding policy "4:2"
+// into the copies and copy_policy fields of a vdi request
+func parseCopies(copies string) (uint8, uint8, error) {
+	parts := strings.Split(copies, ":")
+	switch len(parts) {
+	case 1:
+		n, err := strconv.ParseUint(parts[0], 10, 8)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid copies: %s", copies)
+		}
+		return uint8(n), 0, nil
+	case 2:
+		d, err := strconv.ParseUint(parts[0], 10, 4)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid copies: %s", copies)
+		}
+		p, err := strconv.ParseUint(parts[1], 10, 4)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid copies: %s", copies)
+		}
+		return uint8(d + p), uint8(d<<4 | p), nil
+	}
+	return 0, 0, fmt.Errorf("invalid copies: %s", copies)
+}
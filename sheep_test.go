@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sheepRequest is a request received by fakeSheep
+type sheepRequest struct {
+	Req  sdReq
+	Data []byte
+}
+
+// fakeSheep answers the sheep protocol on a unix socket with handle
+// and records the requests. A nil handle never answers.
+type fakeSheep struct {
+	dir      string
+	listener net.Listener
+	handle   func(req sdReq, data []byte) (sdRsp, []byte)
+
+	mu       sync.Mutex
+	requests []sheepRequest
+}
+
+func newFakeSheep(t *testing.T, handle func(req sdReq, data []byte) (sdRsp, []byte)) *fakeSheep {
+	dir, err := ioutil.TempDir("", "sheep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s := &fakeSheep{dir: dir, listener: l, handle: handle}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSheep) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.answer(conn)
+	}
+}
+
+func (s *fakeSheep) answer(conn net.Conn) {
+	defer conn.Close()
+	var req sdReq
+	if err := binary.Read(conn, binary.LittleEndian, &req); err != nil {
+		return
+	}
+	var data []byte
+	if req.Flags&sdFlagCmdWrite != 0 {
+		data = make([]byte, req.DataLength)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, sheepRequest{Req: req, Data: data})
+	s.mu.Unlock()
+
+	if s.handle == nil {
+		time.Sleep(time.Second)
+		return
+	}
+	rsp, payload := s.handle(req, data)
+	rsp.ProtoVer = sdProtoVer
+	rsp.Opcode = req.Opcode
+	rsp.ID = req.ID
+	rsp.DataLength = uint32(len(payload))
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &rsp)
+	buf.Write(payload)
+	conn.Write(buf.Bytes())
+}
+
+func (s *fakeSheep) client() *SheepClient {
+	return &SheepClient{Network: "unix", Address: s.listener.Addr().String()}
+}
+
+func (s *fakeSheep) received() []sheepRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sheepRequest{}, s.requests...)
+}
+
+func (s *fakeSheep) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+// answerVdiID is a handler answering every request with vdi id vid
+func answerVdiID(vid uint32) func(sdReq, []byte) (sdRsp, []byte) {
+	return func(sdReq, []byte) (sdRsp, []byte) {
+		var rsp sdRsp
+		binary.LittleEndian.PutUint32(rsp.Args[4:], vid)
+		return rsp, nil
+	}
+}
+
+// answerResult is a handler failing every request with code
+func answerResult(code uint32) func(sdReq, []byte) (sdRsp, []byte) {
+	return func(sdReq, []byte) (sdRsp, []byte) {
+		return sdRsp{Result: code}, nil
+	}
+}
+
+// testInode encodes the header of an inode object
+func testInode(name, tag string, size uint64, vid, snapid uint32, snapCtime uint64) []byte {
+	buf := make([]byte, sdInodeHeaderLen)
+	le := binary.LittleEndian
+	copy(buf[0:], name)
+	copy(buf[sdMaxVdiLen:], tag)
+	le.PutUint64(buf[512:], uint64(1507000000)<<32)
+	le.PutUint64(buf[520:], snapCtime)
+	le.PutUint64(buf[536:], size)
+	buf[554] = 3
+	buf[555] = 22
+	le.PutUint32(buf[556:], snapid)
+	le.PutUint32(buf[560:], vid)
+	return buf
+}
+
+func TestSheepClientLookup(t *testing.T) {
+	s := newFakeSheep(t, answerVdiID(0x7c2b25))
+	defer s.Close()
+
+	vid, err := s.client().Lookup("dvp-vol1", "snap1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vid != 0x7c2b25 {
+		t.Errorf("vid = %x, want 7c2b25", vid)
+	}
+
+	reqs := s.received()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests, want 1", len(reqs))
+	}
+	r := reqs[0]
+	if r.Req.ProtoVer != sdProtoVer || r.Req.Opcode != sdOpGetVdi || r.Req.Flags != sdFlagCmdWrite {
+		t.Errorf("header = %+v", r.Req)
+	}
+	if r.Req.DataLength != sdMaxVdiLen+sdMaxVdiTagLen || len(r.Data) != sdMaxVdiLen+sdMaxVdiTagLen {
+		t.Errorf("data length = %d (%d sent)", r.Req.DataLength, len(r.Data))
+	}
+	if got := binary.LittleEndian.Uint32(r.Req.Args[16:]); got != 2 {
+		t.Errorf("snapid = %d, want 2", got)
+	}
+	if name := cString(r.Data[:sdMaxVdiLen]); name != "dvp-vol1" {
+		t.Errorf("name = %q", name)
+	}
+	if tag := cString(r.Data[sdMaxVdiLen:]); tag != "snap1" {
+		t.Errorf("tag = %q", tag)
+	}
+}
+
+func TestSheepClientExist(t *testing.T) {
+	tests := []struct {
+		handle func(sdReq, []byte) (sdRsp, []byte)
+		exist  bool
+		err    bool
+	}{
+		{answerVdiID(1), true, false},
+		{answerResult(sdResNoVdi), false, false},
+		{answerResult(sdResSystemError), false, true},
+	}
+	for i, tt := range tests {
+		s := newFakeSheep(t, tt.handle)
+		exist, err := s.client().Exist("dvp-vol1")
+		s.Close()
+		if exist != tt.exist || (err != nil) != tt.err {
+			t.Errorf("%d: Exist = %v, %v", i, exist, err)
+		}
+	}
+}
+
+func TestSheepClientCreate(t *testing.T) {
+	s := newFakeSheep(t, answerVdiID(42))
+	defer s.Close()
+
+	vid, err := s.client().Create("dvp-vol1", "10G", map[string]string{"copies": "4:2", "hyper": "true", "bsize": "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vid != 42 {
+		t.Errorf("vid = %d, want 42", vid)
+	}
+
+	r := s.received()[0]
+	if r.Req.Opcode != sdOpNewVdi || r.Req.Flags != sdFlagCmdWrite {
+		t.Errorf("header = %+v", r.Req)
+	}
+	le := binary.LittleEndian
+	if size := le.Uint64(r.Req.Args[0:]); size != 10<<30 {
+		t.Errorf("size = %d", size)
+	}
+	if copies, policy, store, bsize := r.Req.Args[12], r.Req.Args[13], r.Req.Args[14], r.Req.Args[15]; copies != 6 || policy != 0x42 || store != 1 || bsize != 22 {
+		t.Errorf("copies = %d, copy policy = %x, store policy = %d, bsize = %d", copies, policy, store, bsize)
+	}
+	if len(r.Data) != sdMaxVdiLen || cString(r.Data) != "dvp-vol1" {
+		t.Errorf("data = %q (%d bytes)", cString(r.Data), len(r.Data))
+	}
+}
+
+func TestSheepClientCreateInvalid(t *testing.T) {
+	c := &SheepClient{Network: "unix", Address: "/nonexistent"}
+	for _, opts := range []map[string]string{
+		{"prealloc": "true"},
+		{"copies": "x"},
+		{"bsize": "300"},
+	} {
+		if _, err := c.Create("dvp-vol1", "10G", opts); err == nil {
+			t.Errorf("Create with %v succeeded", opts)
+		}
+	}
+	if _, err := c.Create("dvp-vol1", "10X", nil); err == nil {
+		t.Error("Create with size 10X succeeded")
+	}
+}
+
+func TestSheepClientDelete(t *testing.T) {
+	s := newFakeSheep(t, answerVdiID(0))
+	defer s.Close()
+
+	if err := s.client().Delete("dvp-vol1"); err != nil {
+		t.Fatal(err)
+	}
+	r := s.received()[0]
+	if r.Req.Opcode != sdOpDelVdi || r.Req.Flags != sdFlagCmdWrite {
+		t.Errorf("header = %+v", r.Req)
+	}
+	if len(r.Data) != sdMaxVdiLen+sdMaxVdiTagLen || cString(r.Data[:sdMaxVdiLen]) != "dvp-vol1" || cString(r.Data[sdMaxVdiLen:]) != "" {
+		t.Errorf("data = %q", r.Data)
+	}
+}
+
+func TestSheepClientReadInode(t *testing.T) {
+	s := newFakeSheep(t, func(sdReq, []byte) (sdRsp, []byte) {
+		return sdRsp{}, testInode("dvp-vol1", "snap1", 10<<30, 0x7c2b25, 2, 1507000100)
+	})
+	defer s.Close()
+
+	inode, err := s.client().ReadInode(0x7c2b25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := s.received()[0]
+	if r.Req.Opcode != sdOpReadObj || r.Req.Flags != 0 || r.Req.DataLength != sdInodeHeaderLen || len(r.Data) != 0 {
+		t.Errorf("header = %+v", r.Req)
+	}
+	if oid := binary.LittleEndian.Uint64(r.Req.Args[0:]); oid != sdVdiBit|uint64(0x7c2b25)<<32 {
+		t.Errorf("oid = %x", oid)
+	}
+
+	if inode.Name != "dvp-vol1" || inode.Tag != "snap1" || inode.VdiSize != 10<<30 || inode.VdiID != 0x7c2b25 || inode.SnapID != 2 {
+		t.Errorf("inode = %+v", inode)
+	}
+	if inode.IsSnapshot() == false || inode.Redundancy() != "3" || inode.BlockSizeShift != 22 {
+		t.Errorf("snapshot = %v, redundancy = %s, bsize = %d", inode.IsSnapshot(), inode.Redundancy(), inode.BlockSizeShift)
+	}
+	if inode.CreateTime.Unix() != 1507000000 {
+		t.Errorf("create time = %v", inode.CreateTime)
+	}
+}
+
+func TestSheepClientReadInodeShort(t *testing.T) {
+	s := newFakeSheep(t, func(sdReq, []byte) (sdRsp, []byte) {
+		return sdRsp{}, make([]byte, 10)
+	})
+	defer s.Close()
+
+	if _, err := s.client().ReadInode(1); err == nil {
+		t.Error("short inode was accepted")
+	}
+}
+
+func TestSheepClientList(t *testing.T) {
+	inodes := map[uint64][]byte{
+		1: testInode("dvp-vol1", "", 10<<30, 1, 0, 0),
+		// deleted vdi
+		2: testInode("", "", 0, 2, 0, 0),
+		9: testInode("dvp-vol2", "", 1<<30, 9, 0, 0),
+	}
+	s := newFakeSheep(t, func(req sdReq, _ []byte) (sdRsp, []byte) {
+		if req.Opcode == sdOpReadVdis {
+			// vids 1, 2 and 9 are in use
+			return sdRsp{}, []byte{0x06, 0x02}
+		}
+		vid := (binary.LittleEndian.Uint64(req.Args[0:]) &^ sdVdiBit) >> 32
+		return sdRsp{}, inodes[vid]
+	})
+	defer s.Close()
+
+	list, err := s.client().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "dvp-vol1" || list[1].Name != "dvp-vol2" {
+		t.Fatalf("list = %+v", list)
+	}
+
+	reqs := s.received()
+	if len(reqs) != 4 {
+		t.Fatalf("%d requests, want 4", len(reqs))
+	}
+	if r := reqs[0].Req; r.Opcode != sdOpReadVdis || r.Flags != 0 || r.DataLength != sdNrVdis/8 {
+		t.Errorf("read vdis header = %+v", r)
+	}
+}
+
+func TestSheepClientErrors(t *testing.T) {
+	tests := []struct {
+		code      uint32
+		msg       string
+		retryable bool
+	}{
+		{sdResNoVdi, "sheep lookup: No VDI found", false},
+		{sdResVdiExist, "sheep lookup: VDI exists already", false},
+		{sdResStartup, "sheep lookup: System is still booting", true},
+		{sdResWaitForJoin, "sheep lookup: Waiting for other nodes to join cluster", true},
+		{sdResHalt, "sheep lookup: IO has halted as there are not enough living nodes", true},
+		{0x99, "sheep lookup: result 0x99", false},
+	}
+	for _, tt := range tests {
+		s := newFakeSheep(t, answerResult(tt.code))
+		_, err := s.client().Lookup("dvp-vol1", "", 0)
+		s.Close()
+		serr, ok := err.(*SheepError)
+		if ok == false || serr.Code != tt.code {
+			t.Errorf("code %x: err = %v", tt.code, err)
+			continue
+		}
+		if err.Error() != tt.msg {
+			t.Errorf("code %x: message = %q, want %q", tt.code, err.Error(), tt.msg)
+		}
+		if retryable(err) != tt.retryable {
+			t.Errorf("code %x: retryable = %v", tt.code, retryable(err))
+		}
+	}
+}
+
+func TestSheepClientTimeout(t *testing.T) {
+	s := newFakeSheep(t, nil)
+	defer s.Close()
+
+	c := s.client()
+	c.Timeout = 50 * time.Millisecond
+	_, err := c.Lookup("dvp-vol1", "", 0)
+	if terr, ok := err.(*TimeoutError); ok == false || terr.Command != "sheep lookup" {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+}
+
+func TestSheepClientNotListening(t *testing.T) {
+	c := &SheepClient{Network: "unix", Address: "/nonexistent/sock"}
+	_, err := c.Lookup("dvp-vol1", "", 0)
+	if err == nil {
+		t.Fatal("Lookup succeeded without sheep")
+	}
+	if retryable(err) == false {
+		t.Errorf("dial error %v is not retryable", err)
+	}
+}
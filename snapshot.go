@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// vdi attribute recording the snapshot a clone was created from
+const parentAttr = "dvp.parent"
+
+// snapshot is a sheepdog snapshot of one of our vdis.
+// Its tag is the name of the Docker volume that represents it.
+type snapshot struct {
+	Vdi string
+	Tag string
+	// Docker name of the volume of Vdi
+	Source string
+}
+
+// vdiSnapshots returns the tagged snapshots of our volumes
+// in our namespace
+func (d SheepdogDriver) vdiSnapshots() ([]snapshot, error) {
+	vdis, err := d.ownVdis()
+	return d.snapshotsOf(vdis), err
+}
+
+// snapshotsOf returns the tagged snapshots in our namespace among vdis
+func (d SheepdogDriver) snapshotsOf(vdis []ownVdi) []snapshot {
+	var snaps []snapshot
+	for _, o := range vdis {
+		if o.Snapshot == false || o.Tag == "" || d.checkNamespace(o.Options, o.OptionsErr) != nil {
+			continue
+		}
+		snaps = append(snaps, snapshot{Vdi: o.Name, Tag: o.Tag, Source: o.Volume})
+	}
+	return snaps
+}
+
+// findSnapshot looks up the snapshot tagged with the volume name.
+// The plugin keeps snapshot names unique across volumes, but two hosts
+// taking a snapshot at once or dog used by hand can tag snapshots of
+// several volumes alike. ok is true and err tells when name is ambiguous.
+func (d SheepdogDriver) findSnapshot(name string) (snap snapshot, ok bool, err error) {
+	snaps, err := d.vdiSnapshots()
+	if err != nil {
+		return snap, false, err
+	}
+	var found []snapshot
+	for _, s := range snaps {
+		if s.Tag == name {
+			found = append(found, s)
+		}
+	}
+	if len(found) == 0 {
+		return snap, false, nil
+	}
+	if len(found) > 1 {
+		var sources []string
+		for _, s := range found {
+			sources = append(sources, s.Source)
+		}
+		return found[0], true, errors.New("Snapshot name is ambiguous: " + name + " of " + strings.Join(sources, ", ") + ", use volume@tag")
+	}
+	return found[0], true, nil
+}
+
+// snapshotVolume describes a snapshot as a Docker volume.
+// Snapshots are never mounted, so there is no Mountpoint.
+func (d SheepdogDriver) snapshotVolume(snap snapshot) *volume.Volume {
+	return &volume.Volume{
+		Name: snap.Tag,
+		Status: map[string]interface{}{
+			"SnapshotOf": snap.Source,
+		},
+	}
+}
+
+// createSnapshot takes a snapshot of the volume source, tagged with name.
+// The caller must hold the driver mutex.
+func (d SheepdogDriver) createSnapshot(name, source string) volume.Response {
+	log.Infof("Create snapshot: %s of %s", name, source)
+
+	srcvdi := d.vdiName(source)
+	if d.vdiExist(srcvdi) == false {
+		err := errors.New("Source volume Not Found: " + source)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	if err := d.checkNamespace(d.readVolumeOptions(srcvdi)); err != nil {
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	if d.vdiExist(d.vdiName(name)) == true {
+		err := errors.New("Volume already exists: " + name)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	err := d.retry("vdi snapshot", func() error {
+		return dogVdiSnapshot(d.Runner, srcvdi, name, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	})
+	if err != nil {
+		log.Error("Error dogVdiSnapshot: ", err)
+		err := commandError("Failed to create snapshot", err)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	// another host may have taken a snapshot with the same name at once
+	if _, _, err := d.findSnapshot(name); err != nil {
+		log.Error(err)
+		if err := dogVdiDeleteSnapshot(d.Runner, srcvdi, name, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort); err != nil {
+			log.Error("Failed to delete the duplicate snapshot: ", err)
+		}
+		err := errors.New("Snapshot name is already used: " + name)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	return volume.Response{}
+}
+
+// removeSnapshot deletes the snapshot behind a snapshot volume
+func (d SheepdogDriver) removeSnapshot(snap snapshot) volume.Response {
+	log.Infof("Remove snapshot: %s of %s", snap.Tag, snap.Vdi)
+
+	err := dogVdiDeleteSnapshot(d.Runner, snap.Vdi, snap.Tag, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err != nil {
+		log.Error("Error dogVdiDeleteSnapshot: ", err)
+		err := commandError("Failed to delete snapshot", err)
+		log.Error(err)
+		return volume.Response{Err: err.Error()}
+	}
+	d.forgetParent(snap.Source + "@" + snap.Tag)
+	return volume.Response{}
+}
+
+// forgetParent removes the parent attribute of the clones of a removed
+// snapshot. The clones keep their data, only the link to the snapshot goes.
+func (d SheepdogDriver) forgetParent(parent string) {
+	vdis, _ := d.ownVdis()
+	for _, o := range vdis {
+		if o.Snapshot == true || o.Clone == false || d.checkNamespace(o.Options, o.OptionsErr) != nil || d.vdiParent(o.Name) != parent {
+			continue
+		}
+		log.Infof("Forgetting the parent %s of %s", parent, o.Name)
+		if err := dogVdiDelattr(d.Runner, o.Name, parentAttr, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort); err != nil {
+			log.Warning("Failed to remove the parent of the clone: ", err)
+		}
+	}
+}
+
+// resolveSnapshot finds the snapshot named by the from option,
+// either "volume@tag" or the name of a snapshot volume
+func (d SheepdogDriver) resolveSnapshot(from string) (snapshot, error) {
+	i := strings.LastIndex(from, "@")
+	if i <= 0 {
+		snap, ok, err := d.findSnapshot(from)
+		if ok == false && err == nil {
+			return snap, errors.New("Snapshot Not Found: " + from)
+		}
+		return snap, err
+	}
+	vdiname, tag := d.vdiName(from[:i]), from[i+1:]
+	snaps, err := d.vdiSnapshots()
+	if err != nil {
+		return snapshot{}, err
+	}
+	for _, snap := range snaps {
+		if snap.Vdi == vdiname && snap.Tag == tag {
+			return snap, nil
+		}
+	}
+	return snapshot{}, errors.New("Snapshot Not Found: " + from)
+}
+
+// createClone creates the volume name as a copy-on-write clone of the
+// snapshot named by from, and records the parent as a vdi attribute.
+// The caller must hold the driver mutex.
+func (d SheepdogDriver) createClone(name, from string) error {
+	log.Infof("Create clone: %s from %s", name, from)
+	vdiname := d.vdiName(name)
+
+	snap, err := d.resolveSnapshot(from)
+	if err != nil {
+		return err
+	}
+	size, err := d.snapshotSize(snap)
+	if err != nil {
+		return err
+	}
+	if err := d.checkQuota(vdiname, size); err != nil {
+		return err
+	}
+
+	err = d.retry("vdi clone", func() error {
+		return dogVdiClone(d.Runner, snap.Vdi, snap.Tag, vdiname, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	})
+	if err != nil {
+		log.Error("Error dogVdiClone: ", err)
+		return commandError("Failed to clone vdi", err)
+	}
+
+	vopts, err := d.readVolumeOptions(snap.Vdi)
+	if err == nil {
+		vopts.Name = name
+		err = d.saveVolumeOptions(vdiname, vopts)
+	}
+	if err != nil {
+		log.Error("Failed to copy the volume options to the clone: ", err)
+		if err := d.vdiDelete(vdiname); err != nil {
+			log.Error("Error vdiDelete: ", err)
+		}
+		return commandError("Failed to store volume options", err)
+	}
+
+	parent := snap.Source + "@" + snap.Tag
+	err = dogVdiSetattr(d.Runner, vdiname, parentAttr, parent, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err != nil {
+		log.Warning("Failed to record the parent of the clone: ", err)
+	}
+	return nil
+}
+
+// snapshotSize returns the size of the vdi when snap was taken
+func (d SheepdogDriver) snapshotSize(snap snapshot) (uint64, error) {
+	infos, err := d.vdiInfos(snap.Vdi)
+	if err != nil {
+		log.Error("Failed to get snapshot information: ", err)
+		return 0, err
+	}
+	for _, info := range infos {
+		if info.Snapshot == true && info.Tag == snap.Tag {
+			return info.Size, nil
+		}
+	}
+	return 0, errors.New("Snapshot Not Found: " + snap.Tag)
+}
+
+// vdiParent returns the snapshot vdiname was cloned from, if any
+func (d SheepdogDriver) vdiParent(vdiname string) string {
+	parent, err := dogVdiGetattr(d.Runner, vdiname, parentAttr, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err != nil {
+		return ""
+	}
+	return parent
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// orphanMountID stands for the mounts of a volume found attached
+// at startup, when the Docker mount IDs holding it are unknown
+const orphanMountID = "orphan"
+
+// volumeState is what the driver knows about a volume attached on this host
+type volumeState struct {
+	Lun    string
+	Device string
+	// Docker mount IDs of the containers using the volume
+	IDs map[string]bool
+}
+
+// driverState holds the volumes attached on this host.
+// It is written to disk on every change, so the LUNs and refcounts
+// survive a crash or a restart of the plugin.
+// Volumes is guarded by the driver mutex. Every save also publishes a
+// copy under mu, which metrics and the admin API read without waiting
+// for the requests in progress.
+type driverState struct {
+	path    string
+	Volumes map[string]*volumeState
+
+	mu        sync.Mutex
+	published map[string]volumeState
+}
+
+// stateCorruptError is a state file which can not be parsed
+type stateCorruptError struct {
+	Path string
+	Err  error
+}
+
+func (e *stateCorruptError) Error() string {
+	return "Driver state " + e.Path + " is corrupt: " + e.Err.Error()
+}
+
+// readState reads the state file without changing it, a missing file
+// is an empty state and a file which can not be parsed an empty state
+// with a *stateCorruptError.
+func readState(path string) (*driverState, error) {
+	s := &driverState{path: path, Volumes: make(map[string]*volumeState)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(content, s); err != nil {
+		s.Volumes = make(map[string]*volumeState)
+		return s, &stateCorruptError{Path: path, Err: err}
+	}
+	if s.Volumes == nil {
+		s.Volumes = make(map[string]*volumeState)
+	}
+	s.publish()
+	return s, nil
+}
+
+// loadState reads the state file for the plugin.
+// A file which can not be parsed is moved aside rather than overwritten
+// by the next save, and the state starts empty: reconcile adopts the
+// volumes still mounted on the host.
+func loadState(path string) (*driverState, error) {
+	s, err := readState(path)
+	cerr, ok := err.(*stateCorruptError)
+	if ok == false {
+		return s, err
+	}
+	aside := path + ".corrupt-" + time.Now().Format("20060102150405")
+	if rerr := os.Rename(path, aside); rerr != nil {
+		return s, rerr
+	}
+	log.Errorf("Driver state %s is corrupt (%v), moved it to %s and starting empty", path, cerr.Err, aside)
+	return s, nil
+}
+
+// publish makes a copy of Volumes the snapshot, the driver mutex is held
+func (s *driverState) publish() {
+	volumes := make(map[string]volumeState)
+	for name, vs := range s.Volumes {
+		c := volumeState{Lun: vs.Lun, Device: vs.Device, IDs: make(map[string]bool)}
+		for id := range vs.IDs {
+			c.IDs[id] = true
+		}
+		volumes[name] = c
+	}
+	s.mu.Lock()
+	s.published = volumes
+	s.mu.Unlock()
+}
+
+// snapshot returns the state as last saved. It is not modified
+// afterwards and may be read without the driver mutex.
+func (s *driverState) snapshot() map[string]volumeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.published == nil {
+		return map[string]volumeState{}
+	}
+	return s.published
+}
+
+// save replaces the state file with the current state.
+// It writes a temporary file and renames it over the old one,
+// so a crash never leaves a truncated state behind.
+func (s *driverState) save() error {
+	s.publish()
+	content, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// volume returns the state of the volume name, adding it when unknown
+func (s *driverState) volume(name string) *volumeState {
+	vs, ok := s.Volumes[name]
+	if !ok {
+		vs = &volumeState{}
+		s.Volumes[name] = vs
+	}
+	if vs.IDs == nil {
+		vs.IDs = make(map[string]bool)
+	}
+	return vs
+}
+
+// count returns the number of mount IDs holding the volume name
+func (s *driverState) count(name string) int {
+	if vs, ok := s.Volumes[name]; ok {
+		return len(vs.IDs)
+	}
+	return 0
+}
+
+// attach records id as a holder of the volume name.
+// It returns false when id was already holding it.
+func (s *driverState) attach(name, id string) bool {
+	vs := s.volume(name)
+	if vs.IDs[id] == true {
+		return false
+	}
+	vs.IDs[id] = true
+	return true
+}
+
+// detach drops id from the holders of the volume name.
+// An unknown id releases the orphan mount, if any, so a volume
+// adopted at startup can still be unmounted.
+// It returns false when nothing was released.
+func (s *driverState) detach(name, id string) bool {
+	vs, ok := s.Volumes[name]
+	if !ok {
+		return false
+	}
+	if vs.IDs[id] == true {
+		delete(vs.IDs, id)
+		return true
+	}
+	if vs.IDs[orphanMountID] == true {
+		delete(vs.IDs, orphanMountID)
+		return true
+	}
+	return false
+}
+
+// saveState persists the driver state, failures are only logged
+// since the operation itself has already been done
+func (d SheepdogDriver) saveState() {
+	if err := d.State.save(); err != nil {
+		log.Error("Failed to save driver state: ", err)
+	}
+}
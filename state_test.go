@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "state.json")
+
+	s, err := loadState(path)
+	if err != nil || len(s.Volumes) != 0 {
+		t.Fatalf("missing file: %+v, %v", s.Volumes, err)
+	}
+	s.volume("vol1").Lun = "1"
+	s.volume("vol1").Device = "/dev/sdb"
+	s.attach("vol1", "c1")
+	s.attach("vol1", "c2")
+	s.volume("vol2").Lun = "2"
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(loaded.Volumes, s.Volumes) == false {
+		t.Errorf("loaded %+v, saved %+v", loaded.Volumes, s.Volumes)
+	}
+	if loaded.count("vol1") != 2 || loaded.count("vol3") != 0 {
+		t.Errorf("count: %d, %d", loaded.count("vol1"), loaded.count("vol3"))
+	}
+
+	// the state is renamed into place, no temporary file is left
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "state.json" {
+		t.Errorf("files left: %v", files)
+	}
+}
+
+func TestStateSaveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, _ := loadState(path)
+	s.volume("vol1").Lun = "1"
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	// a directory in the way of the rename keeps the old state
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "x"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.save(); err == nil {
+		t.Error("save over a directory succeeded")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("files left: %v", files)
+	}
+}
+
+func TestStateCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"Volumes": {"vol1": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the corrupt file is kept aside and the state starts empty
+	s, err := loadState(path)
+	if err != nil || len(s.Volumes) != 0 {
+		t.Fatalf("corrupt file: %+v, %v", s.Volumes, err)
+	}
+	matches, _ := filepath.Glob(path + ".corrupt-*")
+	if len(matches) != 1 {
+		t.Fatalf("moved aside: %v", matches)
+	}
+	if content, _ := ioutil.ReadFile(matches[0]); string(content) != `{"Volumes": {"vol1": ` {
+		t.Errorf("moved aside: %q", content)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) == false {
+		t.Error("corrupt file left in place: ", err)
+	}
+
+	// and is not overwritten by the next save
+	s.attach("vol2", "c1")
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(path + ".corrupt-*"); len(matches) != 1 {
+		t.Errorf("moved aside after save: %v", matches)
+	}
+}
+
+func TestStateReadCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"Volumes": {"vol1": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the subcommands report the corrupt file and leave it in place
+	s, err := readState(path)
+	if _, ok := err.(*stateCorruptError); ok == false || len(s.Volumes) != 0 {
+		t.Fatalf("corrupt file: %+v, %v", s.Volumes, err)
+	}
+	if matches, _ := filepath.Glob(path + ".corrupt-*"); len(matches) != 0 {
+		t.Errorf("moved aside: %v", matches)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != `{"Volumes": {"vol1": ` {
+		t.Errorf("changed: %q", content)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// volumeStatus collects what docker volume inspect shows in Status:
+// the sheepdog side of the vdi and, when the volume is attached on
+// this host, its LUN, device, holders and filesystem usage.
+// The caller must hold the driver mutex.
+func (d SheepdogDriver) volumeStatus(name, vdiname string) map[string]interface{} {
+	status := map[string]interface{}{
+		"Vdi": vdiname,
+	}
+
+	infos, err := d.vdiInfos(vdiname)
+	if err != nil {
+		log.Warning("Failed to get vdi information: ", err)
+	}
+	snapshots := 0
+	for _, info := range infos {
+		if info.Snapshot == true {
+			snapshots++
+			continue
+		}
+		status["Size"] = info.Size
+		// the native client only reads the inode header
+		if d.Conf.NativeClient == false {
+			status["Used"] = info.Used
+		}
+		status["Redundancy"] = info.Copies
+		status["BlockSizeShift"] = info.BlockSizeShift
+		status["CreatedAt"] = info.CreateTime.Format(time.RFC3339)
+	}
+	status["Snapshots"] = snapshots
+
+	status["Options"] = d.loadVolumeOptions(vdiname)
+	if parent := d.vdiParent(vdiname); parent != "" {
+		status["Parent"] = parent
+	}
+
+	if lock, ok, err := d.readLock(vdiname); err != nil {
+		status["AttachedHost"] = "unknown"
+	} else if ok {
+		status["AttachedHost"] = lock.Host
+	}
+
+	vs, ok := d.State.Volumes[name]
+	if !ok || len(vs.IDs) == 0 {
+		status["Attached"] = false
+		return status
+	}
+	status["Attached"] = true
+	status["Lun"] = vs.Lun
+	status["Device"] = vs.Device
+	status["MountCount"] = len(vs.IDs)
+	if vs.Device != "" {
+		status["FsType"] = getFSType(d.Runner, vs.Device)
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Join(d.Conf.MountPoint, name), &st); err == nil {
+		bsize := uint64(st.Bsize)
+		status["FsSize"] = st.Blocks * bsize
+		status["FsUsed"] = (st.Blocks - st.Bfree) * bsize
+		status["FsAvail"] = st.Bavail * bsize
+	} else {
+		log.Warning("Failed to statfs: ", err)
+	}
+	return status
+}
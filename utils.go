@@ -2,178 +2,270 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	log "github.com/Sirupsen/logrus"
-	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// Check if the command is supported
-func iscmdSupported(execCmd string) bool {
-	_, err := exec.Command(execCmd, "-h").CombinedOutput()
-	if err != nil {
-		log.Debug("%s command not found on this host", execCmd)
-		return false
-	}
-	return true
-}
-
 // dog vdi create volume 10G
-func dogVdiCreate(vdiname, vdisize, sheepip, sheepport string, opts map[string]string) error {
+func dogVdiCreate(runner Runner, vdiname, vdisize, sheepip, sheepport string, opts map[string]string) error {
 	log.Debugf("Begin utils.dogVdiCreate: %s, %s", vdiname, vdisize)
 
-	var (
-		otheropts string
-		sheepopts string
-		cmd       string
-	)
-
+	args := []string{"dog", "vdi", "create", "-v"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
+	}
 	if opts["prealloc"] == "true" {
-		otheropts += " --prealloc"
+		args = append(args, "--prealloc")
 	}
 	if opts["hyper"] == "true" {
-		otheropts += " --hyper"
+		args = append(args, "--hyper")
 	}
 	if opts["copies"] != "" {
-		otheropts += " --copies " + opts["copies"]
+		args = append(args, "--copies", opts["copies"])
 	}
 	if opts["bsize"] != "" {
-		otheropts += " --block_size_shift " + opts["bsize"]
+		args = append(args, "--block_size_shift", opts["bsize"])
 	}
-	log.Debugf("utils.dogVdiCreate options: %s", otheropts)
+	args = append(args, vdiname, vdisize)
+	log.Debugf("utils.dogVdiCreate args: %v", args)
 
-	if sheepip != "" {
-		sheepopts = "-a " + sheepip + " -p " + sheepport
-	}
-	log.Debugf("utils.dogVdiCreate sheep options: %s", sheepopts)
-
-	cmd = "sudo dog vdi create -v " + sheepopts + " " + vdiname + " " + vdisize + otheropts
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	out, err := runner.Run("sudo", args...)
 	log.Debug("Result of dogVdiCreate: ", string(out))
-
 	return err
 }
 
 // dog vdi delete volume
-func dogVdiDelete(vdiname, sheepip, sheepport string) error {
+func dogVdiDelete(runner Runner, vdiname, sheepip, sheepport string) error {
 	log.Debugf("Begin utils.dogVdiDelete: %s", vdiname)
 
-	var (
-		sheepopts string
-		cmd       string
-	)
+	args := []string{"dog", "vdi", "delete"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
+	}
+	args = append(args, vdiname)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiDelete: ", string(out))
+	return err
+}
+
+// dog vdi list -r [volume]
+// returns the raw listing of vdiname and its snapshots, or of all the vdis
+// when vdiname is empty, see parseVdiList
+func dogVdiListRaw(runner Runner, vdiname, sheepip, sheepport string) (string, error) {
+	log.Debugf("Begin utils.dogVdiListRaw: %s", vdiname)
 
+	args := []string{"dog", "vdi", "list", "-r"}
 	if sheepip != "" {
-		sheepopts = "-a " + sheepip + " -p " + sheepport
+		args = append(args, "-a", sheepip, "-p", sheepport)
+	}
+	if vdiname != "" {
+		args = append(args, vdiname)
+	}
+	out, err := runner.Run("sudo", args...)
+	if err != nil {
+		log.Debug("Result of dogVdiListRaw: ", string(out))
+		return "", err
 	}
-	log.Debugf("utils.dogVdiCreate sheep options: %s", sheepopts)
+	return string(out), nil
+}
 
-	cmd = "sudo dog vdi delete " + sheepopts + " " + vdiname
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
-	log.Debug("Result of dogVdiDelete: ", string(out))
+// dog cluster info
+// returns the first line, e.g. "Cluster status: running, auto-recovery enabled"
+func dogClusterInfo(runner Runner, sheepip, sheepport string) (string, error) {
+	log.Debugf("Begin utils.dogClusterInfo")
+
+	args := []string{"dog", "cluster", "info"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
+	}
+	out, err := runner.Run("sudo", args...)
+	status := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	if err != nil {
+		log.Debug("Result of dogClusterInfo: ", string(out))
+		if status != "" {
+			return status, errors.New(status)
+		}
+		return "", err
+	}
+	return status, nil
+}
+
+// dog vdi snapshot -s tag volume
+func dogVdiSnapshot(runner Runner, vdiname, tag, sheepip, sheepport string) error {
+	log.Debugf("Begin utils.dogVdiSnapshot: %s, %s", vdiname, tag)
+
+	args := []string{"dog", "vdi", "snapshot"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
+	}
+	args = append(args, "-s", tag, vdiname)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiSnapshot: ", string(out))
 	return err
 }
 
-// dog vdi list
-func dogVdiList(suffix, sheepip, sheepport string) (list string) {
-	log.Debugf("Begin utils.dogVdiList:")
+// dog vdi delete -s tag volume
+func dogVdiDeleteSnapshot(runner Runner, vdiname, tag, sheepip, sheepport string) error {
+	log.Debugf("Begin utils.dogVdiDeleteSnapshot: %s, %s", vdiname, tag)
 
-	var (
-		sheepopts string
-		cmd       string
-	)
+	args := []string{"dog", "vdi", "delete"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
+	}
+	args = append(args, "-s", tag, vdiname)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiDeleteSnapshot: ", string(out))
+	return err
+}
+
+// dog vdi clone -s tag volume newvolume
+func dogVdiClone(runner Runner, srcvdi, tag, dstvdi, sheepip, sheepport string) error {
+	log.Debugf("Begin utils.dogVdiClone: %s@%s, %s", srcvdi, tag, dstvdi)
 
+	args := []string{"dog", "vdi", "clone"}
 	if sheepip != "" {
-		sheepopts = "-a " + sheepip + " -p " + sheepport
+		args = append(args, "-a", sheepip, "-p", sheepport)
 	}
-	log.Debugf("utils.dogVdiCreate sheep options: %s", sheepopts)
+	args = append(args, "-s", tag, srcvdi, dstvdi)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiClone: ", string(out))
+	return err
+}
 
-	cmd = "sudo dog vdi list -r " + sheepopts + " |grep  ^= | grep " + suffix + " |cut -d' ' -f 2"
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
-	if err != nil {
-		log.Error("Failed to list vdi: ", err)
-		return
+// dog vdi resize volume 20G
+func dogVdiResize(runner Runner, vdiname, vdisize, sheepip, sheepport string) error {
+	log.Debugf("Begin utils.dogVdiResize: %s, %s", vdiname, vdisize)
+
+	args := []string{"dog", "vdi", "resize"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
 	}
-	list = string(out)
-	return list
+	args = append(args, vdiname, vdisize)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiResize: ", string(out))
+	return err
 }
 
-// dog vdi list -r |grep  ^= | grep -w " + vdiname + "|cut -d' ' -f 2"
-func dogVdiExist(vdiname, sheepip, sheepport string) bool {
-	log.Debugf("Begin utils.dogVdiExist: %s", vdiname)
-	var (
-		sheepopts string
-		cmd       string
-	)
+// dog vdi setattr volume key value
+func dogVdiSetattr(runner Runner, vdiname, key, value, sheepip, sheepport string) error {
+	log.Debugf("Begin utils.dogVdiSetattr: %s, %s", vdiname, key)
 
+	args := []string{"dog", "vdi", "setattr"}
 	if sheepip != "" {
-		sheepopts = "-a " + sheepip + " -p " + sheepport
+		args = append(args, "-a", sheepip, "-p", sheepport)
 	}
-	log.Debugf("utils.dogVdiCreate sheep options: %s", sheepopts)
+	args = append(args, vdiname, key, value)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiSetattr: ", string(out))
+	return err
+}
 
-	cmd = "sudo dog vdi list -r " + sheepopts + "|grep  ^= | grep -w " + vdiname + "|cut -d' ' -f 2"
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
-	if err != nil {
-		log.Error("Failed to list vdi: ", err)
-		return false
+// dog vdi setattr -x volume key value
+// fails when the key is already set
+func dogVdiSetattrExclusive(runner Runner, vdiname, key, value, sheepip, sheepport string) error {
+	log.Debugf("Begin utils.dogVdiSetattrExclusive: %s, %s", vdiname, key)
+
+	args := []string{"dog", "vdi", "setattr", "-x"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
 	}
+	args = append(args, vdiname, key, value)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiSetattrExclusive: ", string(out))
+	return err
+}
+
+// dog vdi setattr -d volume key
+func dogVdiDelattr(runner Runner, vdiname, key, sheepip, sheepport string) error {
+	log.Debugf("Begin utils.dogVdiDelattr: %s, %s", vdiname, key)
 
-	log.Debugf("out: %s", string(out))
-	if string(out) != "" {
-		log.Debugf("vdi exist")
-		return true
+	args := []string{"dog", "vdi", "setattr", "-d"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
 	}
-	log.Debugf("vdi not exist")
-	return false
+	args = append(args, vdiname, key)
+	out, err := runner.Run("sudo", args...)
+	log.Debug("Result of dogVdiDelattr: ", string(out))
+	return err
+}
+
+// errAttrNotFound is returned by dogVdiGetattr when the attribute is not set
+var errAttrNotFound = errors.New("Attribute not found")
+
+// dog vdi getattr volume key
+func dogVdiGetattr(runner Runner, vdiname, key, sheepip, sheepport string) (string, error) {
+	log.Debugf("Begin utils.dogVdiGetattr: %s, %s", vdiname, key)
+
+	args := []string{"dog", "vdi", "getattr"}
+	if sheepip != "" {
+		args = append(args, "-a", sheepip, "-p", sheepport)
+	}
+	args = append(args, vdiname, key)
+	out, err := runner.Run("sudo", args...)
+	if err != nil {
+		log.Debug("Result of dogVdiGetattr: ", string(out))
+		// Attribute 'dvp.lock' not found
+		if _, ok := err.(*CommandError); ok && strings.Contains(string(out), "not found") {
+			return "", errAttrNotFound
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\x00\n"), nil
 }
 
 // tgtadm --lld iscsi --mode target --op new --tid 1 --targetname iqn.2017-09.org.sheepdog-docker
-func tgtTargetNew(tid, tname string) error {
+func tgtTargetNew(runner Runner, tid, tname string) error {
 	log.Debugf("Begin utils.tgtTargetNew: %s, %s", tid, tname)
-	out, err := exec.Command("sudo", "tgtadm", "--lld", "iscsi", "--mode", "target",
-		"--op", "new", "--tid", tid, "--targetname", tname).CombinedOutput()
+	out, err := runner.Run("sudo", "tgtadm", "--lld", "iscsi", "--mode", "target",
+		"--op", "new", "--tid", tid, "--targetname", tname)
 	log.Debug("Result of tgtTargetNew: ", string(out))
 	return err
 }
 
 // tgtadm --lld iscsi --mode target --op bind --tid 1 --initiator-address 127.0.0.1
-func tgtTargetBind(tid, tallow string) error {
+func tgtTargetBind(runner Runner, tid, tallow string) error {
 	log.Debugf("Begin utils.tgtTargetBind: %s, %s", tid, tallow)
-	out, err := exec.Command("sudo", "tgtadm", "--lld", "iscsi", "--mode", "target",
-		"--op", "bind", "--tid", tid, "--initiator-address", tallow).CombinedOutput()
+	out, err := runner.Run("sudo", "tgtadm", "--lld", "iscsi", "--mode", "target",
+		"--op", "bind", "--tid", tid, "--initiator-address", tallow)
 	log.Debug("Result of tgtTargetBind: ", string(out))
 	return err
 }
 
 // tgtadm --lld iscsi --mode logicalunit --op new --tid 1 --lun 2 --bstype sheepdog --backing-store unix:/var/lib/sheepdog/sock:dvp-vol1
-func tgtLunNew(tid, lun, bstore string) error {
+func tgtLunNew(runner Runner, tid, lun, bstore string) error {
 	log.Debugf("Begin utils.tgtLunNew: %s, %s, %s", tid, lun, bstore)
-	out, err := exec.Command("sudo", "tgtadm", "--lld", "iscsi", "--mode", "logicalunit",
+	out, err := runner.Run("sudo", "tgtadm", "--lld", "iscsi", "--mode", "logicalunit",
 		"--op", "new", "--tid", tid, "--lun", lun, "--bstype", "sheepdog",
-		"--backing-store", bstore).CombinedOutput()
+		"--backing-store", bstore)
 	log.Debug("Result of tgtLunNew: ", string(out))
 	return err
 }
 
 // tgtadm --lld iscsi --mode logicalunit --op delete --tid 1 --lun 2
-func tgtLunDelete(tid, lun string) error {
+// A LUN which does not exist is taken as deleted.
+func tgtLunDelete(runner Runner, tid, lun string) error {
 	log.Debugf("Begin utils.tgtLunDelete: %s, %s", tid, lun)
 
-	out, err := exec.Command("sudo", "tgtadm", "--lld", "iscsi", "--mode", "logicalunit",
-		"--op", "delete", "--tid", tid, "--lun", lun).CombinedOutput()
+	out, err := runner.Run("sudo", "tgtadm", "--lld", "iscsi", "--mode", "logicalunit",
+		"--op", "delete", "--tid", tid, "--lun", lun)
 	log.Debug("Result of tgtLunDelete: ", string(out))
+	if cerr, ok := err.(*CommandError); ok && strings.Contains(cerr.Output, "can't find the logical unit") {
+		return nil
+	}
 	return err
 }
 
 // iscsiadm -m discovery -t st -p 127.0.0.1:3260
-func iscsiDiscovery(tportal string) (targets []string, err error) {
+func iscsiDiscovery(runner Runner, tportal string) (targets []string, err error) {
 	log.Debugf("Begin utils.iscsiDiscovery (portal: %s)", tportal)
-	out, err := exec.Command("sudo", "iscsiadm", "--mode", "discovery",
-		"--type", "sendtargets", "--portal", tportal).CombinedOutput()
+	out, err := runner.Run("sudo", "iscsiadm", "--mode", "discovery",
+		"--type", "sendtargets", "--portal", tportal)
 	if err != nil {
 		log.Error("Error encountered in sendtargets cmd: ", out)
 		return
@@ -183,10 +275,10 @@ func iscsiDiscovery(tportal string) (targets []string, err error) {
 }
 
 // iscsiadm -m node -T iqn.2017-09.org.sheepdog-docker -l
-func iscsiLogin(tiqn, tportal string) (err error) {
+func iscsiLogin(runner Runner, tiqn, tportal string) (err error) {
 	log.Debugf("Begin utils.iscsiLogin: %s", tiqn)
-	_, err = exec.Command("sudo", "iscsiadm", "--mode", "node",
-		"--targetname", tiqn, "--portal", tportal, "--login").CombinedOutput()
+	_, err = runner.Run("sudo", "iscsiadm", "--mode", "node",
+		"--targetname", tiqn, "--portal", tportal, "--login")
 	if err != nil {
 		log.Errorf("Received error on login attempt: %v", err)
 	}
@@ -194,44 +286,112 @@ func iscsiLogin(tiqn, tportal string) (err error) {
 }
 
 // iscsiadm -m node -T iqn.2017-09.org.sheepdog-docker --portal 127.0.0.1:3260 -u
-func iscsiDisableDelete(tiqn, tportal string) (err error) {
+func iscsiDisableDelete(runner Runner, tiqn, tportal string) (err error) {
 	log.Debugf("Begin utils.iscsiDisableDelete: %s", tiqn)
-	_, err = exec.Command("sudo", "iscsiadm", "--mode", "node",
-		"--targetname", tiqn, "--portal", tportal, "--logout").CombinedOutput()
+	_, err = runner.Run("sudo", "iscsiadm", "--mode", "node",
+		"--targetname", tiqn, "--portal", tportal, "--logout")
 	if err != nil {
 		log.Debugf("Error during iscsi logout: ", err)
 	}
-	_, err = exec.Command("sudo", "iscsiadm", "--mode", "node",
-		"--targetname", tiqn, "--op", "delete").CombinedOutput()
+	_, err = runner.Run("sudo", "iscsiadm", "--mode", "node",
+		"--targetname", tiqn, "--op", "delete")
 	return
 }
 
 // iscsiadm -m session --rescan
-func iscsiRescan() bool {
+func iscsiRescan(runner Runner) bool {
 	log.Debugf("Begin utils.iscsiRescan")
-	exec.Command("sudo", "iscsiadm", "--mode", "session", "--rescan").CombinedOutput()
+	runner.Run("sudo", "iscsiadm", "--mode", "session", "--rescan")
 	return true
 }
 
+// iscsiSession is one line of iscsiadm -m session
+type iscsiSession struct {
+	ID     string
+	Portal string
+	Target string
+}
+
+// iscsiadm -m session
+// tcp: [1] 127.0.0.1:3260,1 iqn.2017-09.org.sheepdog-docker (non-flash)
+func iscsiSessionList(runner Runner) (sessions []iscsiSession, err error) {
+	log.Debugf("Begin utils.iscsiSessionList")
+	out, err := runner.Run("sudo", "iscsiadm", "--mode", "session")
+	if err != nil {
+		// iscsiadm fails when there is no session at all
+		if strings.Contains(string(out), "No active sessions") {
+			return sessions, nil
+		}
+		log.Debug("Result of iscsiSessionList: ", string(out))
+		return sessions, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		sessions = append(sessions, iscsiSession{
+			ID:     strings.Trim(fields[1], "[]"),
+			Portal: strings.SplitN(fields[2], ",", 2)[0],
+			Target: fields[3],
+		})
+	}
+	return sessions, nil
+}
+
 // echo 1 > /sys/block/sda/device/delete
-func iscsiDeleteDevice(scsi string) (err error) {
+func iscsiDeleteDevice(runner Runner, scsi string) (err error) {
 	log.Debugf("Begin utils.iscsiDeleteDevice: %s", scsi)
 
-	cmd := "sudo echo 1 > /sys/block/" + scsi + "/device/delete"
-	_, err = exec.Command("sh", "-c", cmd).CombinedOutput()
+	err = writeScsiDeviceAttr(scsi, "delete")
+	if err != nil {
+		log.Debugf("Error during iscsi delete device: %v", err)
+	}
+	return
+}
+
+// echo 1 > /sys/block/sda/device/rescan
+func scsiRescanDevice(runner Runner, scsi string) (err error) {
+	log.Debugf("Begin utils.scsiRescanDevice: %s", scsi)
+
+	err = writeScsiDeviceAttr(scsi, "rescan")
 	if err != nil {
-		log.Debugf("Error during iscsi delete device: ", err)
+		log.Debugf("Error during scsi rescan device: %v", err)
 	}
 	return
 }
 
+// writeScsiDeviceAttr writes 1 to /sys/block/<scsi>/device/<attr>
+func writeScsiDeviceAttr(scsi, attr string) error {
+	if scsi == "" || strings.ContainsAny(scsi, "/") || scsi == "." || scsi == ".." {
+		return errors.New("Invalid device name: " + scsi)
+	}
+	f, err := os.OpenFile("/sys/block/"+scsi+"/device/"+attr, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte("1")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// iscsiByPath returns the udev by-path link of a LUN
+func iscsiByPath(tip, tport, tipn, lun string) string {
+	return "/dev/disk/by-path/ip-" + tip + ":" + tport + "-iscsi-" + tipn + "-lun-" + lun
+}
+
+// detectDeviceTries is how many seconds getDeviceNameFromLun waits for udev
+var detectDeviceTries = 5
+
 // getDeviceNameFromLun
 func getDeviceNameFromLun(tip, tport, tipn, lun string) string {
 	log.Debugf("Begin utils.getDeviceNameFromLun: %s %s", tipn, lun)
 
-	path := "/dev/disk/by-path/ip-" + tip + ":" + tport + "-iscsi-" + tipn + "-lun-" + lun
+	path := iscsiByPath(tip, tport, tipn, lun)
 
-	if waitForDetectDevice(path, 5) {
+	if waitForDetectDevice(path, detectDeviceTries) {
 		log.Debugf("volume path found: %s", path)
 	}
 
@@ -240,60 +400,97 @@ func getDeviceNameFromLun(tip, tport, tipn, lun string) string {
 }
 
 // getLunFromName
-func getLunFromDeviceName(vdiname string) (lun string) {
-	log.Debugf("Begin utils.getLunFromDeviceName: %s", vdiname)
-	// lsblk -P -S --output HCTL,TRAN,MOUNTPOINT |grep -w test1
+func getLunFromDeviceName(runner Runner, mountpoint string) (lun string) {
+	log.Debugf("Begin utils.getLunFromDeviceName: %s", mountpoint)
+	// lsblk -P -S --output HCTL,TRAN,MOUNTPOINT
 	// HCTL="12:0:0:3" TRAN="iscsi" MOUNTPOINT="/mnt/sheepdog/test1"
 	// HCTL = Host:Channel:Target:Lun
-	cmd := "sudo lsblk -P -S --output HCTL,TRAN,MOUNTPOINT | grep iscsi | grep -w " + vdiname
-	log.Debugf("cmd: %s", cmd)
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
-	if err != nil {
-		log.Error("Failed to get lun num: ", err)
+	dev, ok := lsblkIscsiMountedOn(runner, "HCTL", mountpoint)
+	if ok == false {
+		log.Error("Failed to get lun num of ", mountpoint)
 		return
 	}
-	// devlist -> HCTL="12:0:0:3"
-	devlist := strings.Fields(string(out))
-
-	// pos -> 12
-	pos := strings.LastIndex(devlist[0], ":")
-	pos = pos + 1
-
-	// devlist[0][pos:] -> 3"
-	lun = strings.Trim(devlist[0][pos:], "\"")
-
+	// 12:0:0:3 -> 3
+	lun = dev[strings.LastIndex(dev, ":")+1:]
 	return lun
 }
 
 // getLunFromName
-func getScsiNameFromDeviceName(vdiname string) (scsi string) {
-	log.Debugf("Begin utils.getScsiNameFromDeviceName: %s", vdiname)
-	// lsblk -P -S --output NAME,TRAN,MOUNTPOINT |grep -w test1
+func getScsiNameFromDeviceName(runner Runner, mountpoint string) (scsi string) {
+	log.Debugf("Begin utils.getScsiNameFromDeviceName: %s", mountpoint)
+	// lsblk -P -S --output NAME,TRAN,MOUNTPOINT
 	// NAME="sdb" TRAN="iscsi" MOUNTPOINT="/mnt/sheepdog/test1"
-	cmd := "sudo lsblk -P -S --output NAME,TRAN,MOUNTPOINT | grep iscsi | grep -w " + vdiname
-	log.Debugf("cmd: %s", cmd)
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
-	if err != nil {
-		log.Error("Failed to get lun num: ", err)
-		return
+	scsi, ok := lsblkIscsiMountedOn(runner, "NAME", mountpoint)
+	if ok == false {
+		log.Error("Failed to get scsi name of ", mountpoint)
 	}
-	// devlist -> NAME="sdb"
-	devlist := strings.Fields(string(out))
+	return scsi
+}
 
-	// pos -> 12
-	pos := strings.LastIndex(devlist[0], "=")
-	pos = pos + 1
+// lsblkIscsiMountedOn returns the column of the iSCSI disk mounted on mountpoint
+func lsblkIscsiMountedOn(runner Runner, column, mountpoint string) (string, bool) {
+	out, err := runner.Run("sudo", "lsblk", "-P", "-S", "--output", column+",TRAN,MOUNTPOINT")
+	if err != nil {
+		log.Error("Failed to lsblk: ", err)
+		return "", false
+	}
+	for _, dev := range parseLsblkPairs(string(out)) {
+		if dev["TRAN"] == "iscsi" && dev["MOUNTPOINT"] != "" && filepath.Clean(dev["MOUNTPOINT"]) == filepath.Clean(mountpoint) {
+			return dev[column], true
+		}
+	}
+	return "", false
+}
 
-	// devlist[0][pos:] -> sdb"
-	scsi = strings.Trim(devlist[0][pos:], "\"")
+// parseLsblkPairs parses the KEY="value" lines of lsblk -P
+func parseLsblkPairs(out string) []map[string]string {
+	var devs []map[string]string
+	for _, line := range strings.Split(out, "\n") {
+		dev := make(map[string]string)
+		for line != "" {
+			eq := strings.Index(line, "=\"")
+			if eq < 0 {
+				break
+			}
+			key := strings.TrimSpace(line[:eq])
+			rest := line[eq+2:]
+			end := strings.Index(rest, "\"")
+			if end < 0 {
+				break
+			}
+			dev[key] = unescapeLsblk(rest[:end])
+			line = rest[end+1:]
+		}
+		if len(dev) > 0 {
+			devs = append(devs, dev)
+		}
+	}
+	return devs
+}
 
-	return scsi
+// unescapeLsblk resolves the \xNN escapes lsblk -P uses for unsafe characters
+func unescapeLsblk(s string) string {
+	if strings.Contains(s, "\\x") == false {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
 }
 
 // getDeviceFileFromIscsiPath
-func getDeviceFileFromIscsiPath(iscsiPath string) (devFile string) {
+func getDeviceFileFromIscsiPath(runner Runner, iscsiPath string) (devFile string) {
 	log.Debug("Begin utils.getDeviceFileFromIscsiPath: ", iscsiPath)
-	out, err := exec.Command("sudo", "ls", "-la", iscsiPath).CombinedOutput()
+	out, err := runner.Run("sudo", "ls", "-la", iscsiPath)
 	if err != nil {
 		log.Debug(err)
 		return
@@ -307,10 +504,10 @@ func getDeviceFileFromIscsiPath(iscsiPath string) (devFile string) {
 }
 
 // getFSType
-func getFSType(device string) string {
+func getFSType(runner Runner, device string) string {
 	log.Debugf("Begin utils.getFSType: %s", device)
 	fsType := ""
-	out, err := exec.Command("sudo", "blkid", device).CombinedOutput()
+	out, err := runner.Run("sudo", "blkid", device)
 	if err != nil {
 		return fsType
 	}
@@ -327,24 +524,64 @@ func getFSType(device string) string {
 }
 
 // formatVolume
-func formatVolume(device, fsType string) error {
-	log.Debugf("Begin utils.formatVolume: %s, %s", device, fsType)
-	cmd := "mkfs.ext4"
-	if fsType == "xfs" {
-		cmd = "mkfs.xfs"
-	}
+func formatVolume(runner Runner, device, fsType, mkfsOpts string) error {
+	log.Debugf("Begin utils.formatVolume: %s, %s, %s", device, fsType, mkfsOpts)
+	var cmd, force string
+	switch fsType {
+	case "xfs":
+		cmd, force = "mkfs.xfs", "-f"
+	case "ext4":
+		cmd, force = "mkfs.ext4", "-F"
+	case "btrfs":
+		cmd, force = "mkfs.btrfs", "-f"
+	default:
+		return errors.New("Unsupported filesystem: " + fsType)
+	}
+	if err := checkMkfsOpts(fsType, mkfsOpts); err != nil {
+		return err
+	}
+
+	args := []string{cmd, force}
+	args = append(args, strings.Fields(mkfsOpts)...)
+	args = append(args, device)
 	log.Debug("Perform ", cmd, " on device: ", device)
-	out, err := exec.Command("sudo", cmd, "-f", device).CombinedOutput()
+	out, err := runner.Run("sudo", args...)
 	log.Debug("Result of mkfs cmd: ", string(out))
 
 	return err
 }
 
+// growFilesystem grows the filesystem on device to the size of the device
+func growFilesystem(runner Runner, device, mountpoint, fsType string) error {
+	log.Debugf("Begin utils.growFilesystem: %s on %s (%s)", device, mountpoint, fsType)
+	var (
+		out []byte
+		err error
+	)
+	switch fsType {
+	case "xfs":
+		out, err = runner.Run("sudo", "xfs_growfs", mountpoint)
+	case "ext2", "ext3", "ext4":
+		out, err = runner.Run("sudo", "resize2fs", device)
+	case "btrfs":
+		out, err = runner.Run("sudo", "btrfs", "filesystem", "resize", "max", mountpoint)
+	default:
+		return errors.New("Growing " + fsType + " filesystem is not supported")
+	}
+	log.Debug("Result of grow cmd: ", string(out))
+	return err
+}
+
 // mount
-func mount(device, mountpoint string) error {
-	log.Debugf("Begin utils.mount device: %s on: %s", device, mountpoint)
-	out, err := exec.Command("sudo", "mkdir", "-p", mountpoint).CombinedOutput()
-	out, err = exec.Command("sudo", "mount", device, mountpoint).CombinedOutput()
+func mount(runner Runner, device, mountpoint, opts string) error {
+	log.Debugf("Begin utils.mount device: %s on: %s (%s)", device, mountpoint, opts)
+	out, err := runner.Run("sudo", "mkdir", "-p", mountpoint)
+	args := []string{"mount"}
+	if opts != "" {
+		args = append(args, "-o", opts)
+	}
+	args = append(args, device, mountpoint)
+	out, err = runner.Run("sudo", args...)
 	log.Debug("Response from mount ", device, " at ", mountpoint, ": ", string(out))
 	if err != nil {
 		log.Error("Error in mount: ", err)
@@ -352,33 +589,30 @@ func mount(device, mountpoint string) error {
 	return err
 }
 
-func isAlreadyMountingThisVolume(mountpoint string) bool {
-	log.Debugf("Begin utils.isAlreadyMountingThisVolume: ", mountpoint)
-	// lsblk -P -S --output MOUNTPOINT  |grep -w /mnt/sheepdog/test1
-	// null or line > 1
-	cmd := "sudo lsblk -P -S --output MOUNTPOINT | grep -w " + mountpoint + " | wc -l"
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+func isAlreadyMountingThisVolume(runner Runner, mountpoint string) bool {
+	log.Debugf("Begin utils.isAlreadyMountingThisVolume: %s", mountpoint)
+	// lsblk -P -S --output MOUNTPOINT
+	// MOUNTPOINT="/mnt/sheepdog/test1"
+	out, err := runner.Run("sudo", "lsblk", "-P", "-S", "--output", "MOUNTPOINT")
 	if err != nil {
 		log.Error("Failed to lsblk: ", err)
 		return false
 	}
 
-	outInt, err := strconv.Atoi(strings.TrimRight(string(out), "\n"))
-	if err != nil {
-		panic(err)
-	}
-	if outInt != 0 {
-		log.Debugf("mount point found, already used")
-		return true
+	for _, dev := range parseLsblkPairs(string(out)) {
+		if dev["MOUNTPOINT"] == mountpoint {
+			log.Debugf("mount point found, already used")
+			return true
+		}
 	}
 	log.Debugf("mount point not found, can use it")
 	return false
 }
 
 // umount
-func umount(mountpoint string) error {
+func umount(runner Runner, mountpoint string) error {
 	log.Debugf("Begin utils.Umount: %s", mountpoint)
-	out, err := exec.Command("sudo", "umount", mountpoint).CombinedOutput()
+	out, err := runner.Run("sudo", "umount", mountpoint)
 	if err != nil {
 		log.Warningf("Unmount call returned error: %s (%s)", err, out)
 		if strings.Contains(string(out), "not mounted") {
@@ -407,9 +641,8 @@ func waitForDetectDevice(device string, tries int) bool {
 }
 
 // findVacantLun
-func findVacantLun(tid string) (nextVacantLun string) {
+func findVacantLun(runner Runner, tid string) (nextVacantLun string) {
 	var (
-		fp         *os.File
 		tgtFound   int
 		currLunInt int
 	)
@@ -419,22 +652,15 @@ func findVacantLun(tid string) (nextVacantLun string) {
 	log.Debugf("Begin utils.findVacantLun")
 
 	// tgtadm --mode target --op show
-	out, err := exec.Command("sudo", "tgtadm", "--mode", "target", "--op", "show").CombinedOutput()
+	out, err := runner.Run("sudo", "tgtadm", "--mode", "target", "--op", "show")
 	if err != nil {
 		log.Error("Failed to list contents of target options: ", err)
 		return
 	}
-	content := []byte(out)
-	ioutil.WriteFile("/tmp/target_list.txt", content, 0644)
 
 	// The original implementation is here.
 	// https://github.com/fujita/tgt/blob/master/scripts/tgt-setup-lun#L93-L113
-	fp, err = os.Open("/tmp/target_list.txt")
-	if err != nil {
-		panic(err)
-	}
-	defer fp.Close()
-	scanner := bufio.NewScanner(fp)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
 
 	for scanner.Scan() {
 		// Check if we finished going over this target
@@ -467,3 +693,45 @@ func findVacantLun(tid string) (nextVacantLun string) {
 	nextVacantLun = strconv.Itoa(nextVacantLunInt)
 	return nextVacantLun
 }
+
+// tgtLun is a logical unit of a tgt target
+type tgtLun struct {
+	Lun          string
+	BackingStore string
+}
+
+// tgtLunList lists the LUNs of target tid with their backing store,
+// as shown by tgtadm --lld iscsi --mode target --op show
+func tgtLunList(runner Runner, tid string) (luns []tgtLun) {
+	log.Debugf("Begin utils.tgtLunList: %s", tid)
+
+	out, err := runner.Run("sudo", "tgtadm", "--lld", "iscsi", "--mode", "target", "--op", "show")
+	if err != nil {
+		log.Error("Failed to list contents of target options: ", err)
+		return
+	}
+
+	tgtFound := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Target ") {
+			if tgtFound == true {
+				break
+			}
+			tgtFound = strings.HasPrefix(line, "Target "+tid+":")
+			continue
+		}
+		if tgtFound == false {
+			continue
+		}
+		if strings.HasPrefix(line, "LUN:") {
+			luns = append(luns, tgtLun{Lun: strings.TrimSpace(strings.TrimPrefix(line, "LUN:"))})
+			continue
+		}
+		if strings.HasPrefix(line, "Backing store path:") && len(luns) > 0 {
+			luns[len(luns)-1].BackingStore = strings.TrimSpace(strings.TrimPrefix(line, "Backing store path:"))
+		}
+	}
+	return luns
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLsblkPairs(t *testing.T) {
+	cases := []struct {
+		name string
+		out  string
+		want []map[string]string
+	}{
+		{
+			name: "one key",
+			out:  "MOUNTPOINT=\"/mnt/sheepdog/vol1\"\n",
+			want: []map[string]string{{"MOUNTPOINT": "/mnt/sheepdog/vol1"}},
+		},
+		{
+			name: "several keys and lines",
+			out: "HCTL=\"12:0:0:3\" TRAN=\"iscsi\" MOUNTPOINT=\"/mnt/sheepdog/vol1\"\n" +
+				"HCTL=\"2:0:0:0\" TRAN=\"sata\" MOUNTPOINT=\"\"\n",
+			want: []map[string]string{
+				{"HCTL": "12:0:0:3", "TRAN": "iscsi", "MOUNTPOINT": "/mnt/sheepdog/vol1"},
+				{"HCTL": "2:0:0:0", "TRAN": "sata", "MOUNTPOINT": ""},
+			},
+		},
+		{
+			name: "escaped space",
+			out:  `NAME="sdb" MOUNTPOINT="/mnt/sheepdog/my\x20vol"`,
+			want: []map[string]string{{"NAME": "sdb", "MOUNTPOINT": "/mnt/sheepdog/my vol"}},
+		},
+		{
+			name: "bad escape kept",
+			out:  `MOUNTPOINT="/mnt/a\xzz"`,
+			want: []map[string]string{{"MOUNTPOINT": `/mnt/a\xzz`}},
+		},
+		{
+			name: "not pairs",
+			out:  "lsblk: unknown column\n\nNAME=\"sdb\n",
+		},
+	}
+	for _, c := range cases {
+		if got := parseLsblkPairs(c.out); reflect.DeepEqual(got, c.want) == false {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLsblkIscsiMountedOn(t *testing.T) {
+	f := &fakeRunner{}
+	f.on("lsblk", "HCTL=\"2:0:0:0\" TRAN=\"sata\" MOUNTPOINT=\"/mnt/sheepdog/vol1\"\n"+
+		"HCTL=\"12:0:0:3\" TRAN=\"iscsi\" MOUNTPOINT=\"/mnt/sheepdog/vol10\"\n"+
+		"HCTL=\"12:0:0:4\" TRAN=\"iscsi\" MOUNTPOINT=\"/mnt/sheepdog/vol1\"\n")
+
+	cases := map[string]string{
+		"/mnt/sheepdog/vol1":   "4",
+		"/mnt/sheepdog/vol1/":  "4",
+		"/mnt/sheepdog/vol10":  "3",
+		"/mnt/sheepdog/vol100": "",
+		"/mnt/sheepdog":        "",
+	}
+	for mountpoint, want := range cases {
+		if got := getLunFromDeviceName(f, mountpoint); got != want {
+			t.Errorf("%s: got lun %q, want %q", mountpoint, got, want)
+		}
+	}
+}
+
+func TestCheckMkfsOpts(t *testing.T) {
+	cases := []struct {
+		fsType string
+		opts   string
+		ok     bool
+	}{
+		{"xfs", "", true},
+		{"xfs", "-m crc=1", true},
+		{"ext4", "-m 1 -L data", true},
+		{"xfs", "-f", false},
+		{"xfs", "-m -f", false},
+		{"ext4", "-d /etc", false},
+		{"ext4", "/dev/sda", false},
+	}
+	for _, c := range cases {
+		if err := checkMkfsOpts(c.fsType, c.opts); (err == nil) != c.ok {
+			t.Errorf("%s %q: %v", c.fsType, c.opts, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// volumeNameRe is the volume names Docker itself accepts
+var volumeNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// validateVolumeName checks that name is a valid Docker volume name
+// which fits in a snapshot tag. Names too long for a vdi are hashed.
+func (d SheepdogDriver) validateVolumeName(name string) error {
+	if volumeNameRe.MatchString(name) == false {
+		return errors.New("Invalid volume name: " + name)
+	}
+	if len(name) >= sdMaxVdiTagLen {
+		return errors.New("Volume name is too long: " + name)
+	}
+	return nil
+}
+
+// validateCreateOptions checks the values of the Create options
+// before anything is done with them
+func (d SheepdogDriver) validateCreateOptions(opts map[string]string) error {
+	for _, key := range []string{"prealloc", "hyper", "readonly"} {
+		if v, ok := opts[key]; ok && v != "true" && v != "false" {
+			return errors.New("Invalid " + key + ": " + v + ", must be true or false")
+		}
+	}
+	if v, ok := opts["size"]; ok {
+		if size, err := parseSize(v); err != nil || size == 0 {
+			return errors.New("Invalid size: " + v)
+		}
+	}
+	if v, ok := opts["copies"]; ok {
+		if _, _, err := parseCopies(v); err != nil {
+			return errors.New("Invalid copies: " + v)
+		}
+	}
+	if v, ok := opts["bsize"]; ok {
+		// sheepdog accepts objects of 1MB (20) to 2GB (31)
+		if shift, err := strconv.ParseUint(v, 10, 8); err != nil || shift < 20 || shift > 31 {
+			return errors.New("Invalid bsize: " + v)
+		}
+	}
+	if v, ok := opts["snapshot-of"]; ok {
+		if err := d.validateVolumeName(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts["from"]; ok {
+		// volume@tag or the name of a snapshot volume
+		for _, part := range strings.SplitN(v, "@", 2) {
+			if err := d.validateVolumeName(part); err != nil {
+				return errors.New("Invalid from: " + v)
+			}
+		}
+	}
+	return nil
+}
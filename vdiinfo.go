@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// VdiInfo is one vdi, current or snapshot, as listed by dog vdi list -r
+type VdiInfo struct {
+	Name           string
+	ID             uint32
+	SnapID         uint32
+	Size           uint64
+	Used           uint64
+	Shared         uint64
+	CreateTime     time.Time
+	Snapshot       bool
+	Clone          bool
+	Tag            string
+	Copies         string
+	BlockSizeShift uint8
+}
+
+// parseVdiList parses the raw output of dog vdi list -r, one vdi per line:
+//
+//	= dvp-vol1 0 10737418240 4194304 0 1507000000 7c2b25 3  22
+//
+// state (= current, c clone, s snapshot), name, snapshot id, size, used,
+// shared, creation time, vdi id (hex), redundancy, tag, block_size_shift.
+// Spaces and backslashes in the name are escaped with a backslash.
+// Lines that can not be parsed are skipped.
+func parseVdiList(out string) []VdiInfo {
+	var vdis []VdiInfo
+	for _, line := range strings.Split(out, "\n") {
+		fields := splitVdiListLine(line)
+		if len(fields) < 10 {
+			continue
+		}
+
+		var info VdiInfo
+		switch fields[0] {
+		case "=":
+		case "c":
+			info.Clone = true
+		case "s":
+			info.Snapshot = true
+		default:
+			continue
+		}
+		info.Name = fields[1]
+
+		snapid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		info.SnapID = uint32(snapid)
+		if info.Size, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+			continue
+		}
+		if info.Used, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+			continue
+		}
+		if info.Shared, err = strconv.ParseUint(fields[5], 10, 64); err != nil {
+			continue
+		}
+		ctime, err := strconv.ParseInt(fields[6], 10, 64)
+		if err != nil {
+			continue
+		}
+		info.CreateTime = time.Unix(ctime, 0)
+		vid, err := strconv.ParseUint(fields[7], 16, 32)
+		if err != nil {
+			continue
+		}
+		info.ID = uint32(vid)
+		info.Copies = fields[8]
+
+		// older dog does not print block_size_shift
+		info.Tag = fields[9]
+		if len(fields) > 10 {
+			info.Tag = strings.Join(fields[9:len(fields)-1], " ")
+			if bsize, err := strconv.ParseUint(fields[len(fields)-1], 10, 8); err == nil {
+				info.BlockSizeShift = uint8(bsize)
+			}
+		}
+		vdis = append(vdis, info)
+	}
+	return vdis
+}
+
+// splitVdiListLine splits a line on single spaces, keeping empty fields
+// (an empty tag) and resolving the backslash escapes of the name
+func splitVdiListLine(line string) []string {
+	if line == "" {
+		return nil
+	}
+	var (
+		fields []string
+		cur    []byte
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) {
+			i++
+			cur = append(cur, line[i])
+			continue
+		}
+		if c == ' ' {
+			fields = append(fields, string(cur))
+			cur = cur[:0]
+			continue
+		}
+		cur = append(cur, c)
+	}
+	return append(fields, string(cur))
+}
+
+// vdiInfo converts an inode read by the native client.
+// The used and shared sizes are not known from the inode header.
+func (i *SheepInode) vdiInfo() VdiInfo {
+	return VdiInfo{
+		Name:           i.Name,
+		ID:             i.VdiID,
+		SnapID:         i.SnapID,
+		Size:           i.VdiSize,
+		CreateTime:     i.CreateTime,
+		Snapshot:       i.IsSnapshot(),
+		Clone:          !i.IsSnapshot() && i.ParentVdiID != 0,
+		Tag:            i.Tag,
+		Copies:         i.Redundancy(),
+		BlockSizeShift: i.BlockSizeShift,
+	}
+}
+
+// vdiInfos returns the vdi vdiname and its snapshots,
+// or all the vdis of the cluster when vdiname is empty
+func (d SheepdogDriver) vdiInfos(vdiname string) ([]VdiInfo, error) {
+	var infos []VdiInfo
+	if d.Conf.NativeClient == true {
+		inodes, err := d.Sheep.List()
+		if err != nil {
+			return infos, err
+		}
+		for _, inode := range inodes {
+			if vdiname == "" || inode.Name == vdiname {
+				infos = append(infos, inode.vdiInfo())
+			}
+		}
+		return infos, nil
+	}
+
+	out, err := dogVdiListRaw(d.Runner, vdiname, d.Conf.RemoteSheepIP, d.Conf.RemoteSheepPort)
+	if err != nil {
+		return infos, err
+	}
+	return parseVdiList(out), nil
+}
+
+// ownVdi is a vdi or a snapshot of one of our volumes
+type ownVdi struct {
+	VdiInfo
+	// Docker name of the volume, of the source volume for a snapshot
+	Volume string
+	// options of the volume, the ones of the source volume for a snapshot
+	Options volumeOptions
+	// set when the options could not be read
+	OptionsErr error
+}
+
+// ownVdis returns the vdis and snapshots named by VdiNameTemplate,
+// leaving out the vdis of other users of the cluster.
+// The options come from the cache of the listed vdis. A vdi whose options
+// can not be read is returned with OptionsErr set, and without Volume
+// when its name depends on them.
+func (d SheepdogDriver) ownVdis() ([]ownVdi, error) {
+	var own []ownVdi
+	infos, err := d.vdiInfos("")
+	if err != nil {
+		log.Error("Failed to list vdi: ", err)
+		return own, err
+	}
+
+	// snapshots share the options of their current vdi
+	current := make(map[string]VdiInfo)
+	for _, info := range infos {
+		if info.Snapshot == false {
+			current[info.Name] = info
+		}
+	}
+	keys := make(map[string]bool)
+	for _, info := range infos {
+		base, ok := current[info.Name]
+		if ok == false {
+			base = info
+		}
+		o := ownVdi{VdiInfo: info}
+		loaded := false
+		load := func() (volumeOptions, error) {
+			if loaded == false {
+				o.Options, o.OptionsErr = d.listedVolumeOptions(base)
+				loaded = true
+			}
+			return o.Options, o.OptionsErr
+		}
+		if o.Volume = d.resolveVolumeName(info.Name, load); o.Volume == "" && o.OptionsErr == nil {
+			continue
+		}
+		load()
+		keys[optionsKey(base)] = true
+		own = append(own, o)
+	}
+	if d.OptionsCache != nil {
+		d.OptionsCache.retain(keys)
+	}
+	return own, nil
+}
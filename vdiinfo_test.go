@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseVdiList(t *testing.T) {
+	cases := []struct {
+		name string
+		out  string
+		want []VdiInfo
+	}{
+		{
+			name: "current",
+			out:  "= dvp-vol1 0 10737418240 4194304 0 1507000000 7c2b25 3  22\n",
+			want: []VdiInfo{{
+				Name: "dvp-vol1", ID: 0x7c2b25, Size: 10737418240, Used: 4194304,
+				CreateTime: time.Unix(1507000000, 0), Copies: "3", BlockSizeShift: 22,
+			}},
+		},
+		{
+			name: "snapshot with an escaped tag",
+			out:  "s dvp-vol1 2 1073741824 0 4194304 1506000000 7c2b24 4:2 snap\\ x 23\n",
+			want: []VdiInfo{{
+				Name: "dvp-vol1", ID: 0x7c2b24, SnapID: 2, Size: 1073741824, Shared: 4194304,
+				CreateTime: time.Unix(1506000000, 0), Snapshot: true, Tag: "snap x", Copies: "4:2", BlockSizeShift: 23,
+			}},
+		},
+		{
+			name: "clone with an escaped name",
+			out:  "c dvp-my\\ vol\\\\1 0 1073741824 0 0 1508000000 a1 2  22\n",
+			want: []VdiInfo{{
+				Name: "dvp-my vol\\1", ID: 0xa1, Size: 1073741824,
+				CreateTime: time.Unix(1508000000, 0), Clone: true, Copies: "2", BlockSizeShift: 22,
+			}},
+		},
+		{
+			name: "without block_size_shift",
+			out:  "s dvp-vol1 1 1073741824 0 0 1506000000 7c2b24 3 snap1",
+			want: []VdiInfo{{
+				Name: "dvp-vol1", ID: 0x7c2b24, SnapID: 1, Size: 1073741824,
+				CreateTime: time.Unix(1506000000, 0), Snapshot: true, Tag: "snap1", Copies: "3",
+			}},
+		},
+		{
+			name: "garbage",
+			out: "Failed to connect to 127.0.0.1:7000\n" +
+				"x dvp-vol1 0 1 0 0 1507000000 7c2b25 3  22\n" +
+				"= dvp-vol1 0 1G 0 0 1507000000 7c2b25 3  22\n" +
+				"= dvp-vol1 0 1 0 0 1507000000 zz 3  22\n" +
+				"= dvp-vol1 0 1\n\n",
+		},
+		{
+			name: "several",
+			out: "= dvp-a 0 1 0 0 1507000000 1 3  22\n" +
+				"= dvp-b 0 2 0 0 1507000000 2 3  22\n",
+			want: []VdiInfo{
+				{Name: "dvp-a", ID: 1, Size: 1, CreateTime: time.Unix(1507000000, 0), Copies: "3", BlockSizeShift: 22},
+				{Name: "dvp-b", ID: 2, Size: 2, CreateTime: time.Unix(1507000000, 0), Copies: "3", BlockSizeShift: 22},
+			},
+		},
+	}
+	for _, c := range cases {
+		if got := parseVdiList(c.out); reflect.DeepEqual(got, c.want) == false {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}